@@ -3,25 +3,41 @@
 # The directory of this bash script
 base_dir="$(dirname "$(readlink -f "$0")")"
 
+# With stages (see "stages" in config.json), this runs once per stage,
+# with GIT_DEPLOY_STAGE set to the stage's name, ex: build.sh, then test.sh
+my_script="${GIT_DEPLOY_STAGE:-deploy}.sh"
+
 function deploy_local() {
-    echo "Running deploy script for ${GIT_REPO_ID}"
-    bash -o errexit -o nounset "${base_dir}/${GIT_REPO_ID}/deploy.sh"
+    echo "Running ${my_script} for ${GIT_REPO_ID}"
+    bash -o errexit -o nounset "${base_dir}/${GIT_REPO_ID}/${my_script}"
 }
 
 function deploy_trusted() {
-    my_tmp="$(mktemp -d -t "tmp.XXXXXXXXXX")"
-    git clone --depth=1 "${GIT_CLONE_URL}" -b "${GIT_REF_NAME}" "${my_tmp}/${GIT_REPO_NAME}"
+    if [[ -n "${GIT_DEPLOY_WORKSPACE:-}" ]]; then
+        # every stage of the job shares the same checkout
+        my_tmp="${GIT_DEPLOY_WORKSPACE}"
+    else
+        my_tmp="$(mktemp -d -t "tmp.XXXXXXXXXX")"
+    fi
+    if [[ ! -d "${my_tmp}/${GIT_REPO_NAME}" ]]; then
+        git clone --depth=1 "${GIT_CLONE_URL}" -b "${GIT_REF_NAME}" "${my_tmp}/${GIT_REPO_NAME}"
+    fi
 
+    my_status=0
     pushd "${my_tmp}/${GIT_REPO_NAME}"
-        if [[ -f ".gitdeploy/deploy.sh" ]]
+        if [[ -f ".gitdeploy/${my_script}" ]]
         then
-            bash -o errexit -o nounset ".gitdeploy/deploy.sh"
+            bash -o errexit -o nounset ".gitdeploy/${my_script}" || my_status=$?
         else
-            echo "Missing ${GIT_REPO_ID}/.gitdeploy/deploy.sh"
+            echo "Missing ${GIT_REPO_ID}/.gitdeploy/${my_script}"
+            my_status=1
         fi
     popd
 
-    rm -rf "${my_tmp}/${GIT_REPO_NAME}/"
+    if [[ -z "${GIT_DEPLOY_WORKSPACE:-}" ]]; then
+        rm -rf "${my_tmp}/${GIT_REPO_NAME}/"
+    fi
+    return ${my_status}
 }
 
 function show_help() {
@@ -56,12 +72,12 @@ function show_help() {
     sleep 1
 }
 
-if [[ -f "${base_dir}/${GIT_REPO_ID}/deploy.sh" ]]; then
+if [[ -f "${base_dir}/${GIT_REPO_ID}/${my_script}" ]]; then
     deploy_local
-    exit 0
-elif [[ "true" == "${GIT_REPO_TRUSTED}" ]]; then
+    exit $?
+elif [[ "true" == "${GIT_REPO_TRUSTED:-}" ]]; then
     deploy_trusted
-    exit 0
+    exit $?
 else
     show_help
     exit 1
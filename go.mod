@@ -1,6 +1,6 @@
 module git.rootprojects.org/root/gitdeploy
 
-go 1.15
+go 1.20
 
 require (
 	git.rootprojects.org/root/go-gitver/v2 v2.0.2
@@ -10,3 +10,9 @@ require (
 	github.com/joho/godotenv v1.3.0
 	github.com/shurcooL/vfsgen v0.0.0-20200824052919-0d455de96546
 )
+
+require (
+	github.com/google/go-querystring v1.0.0 // indirect
+	github.com/shurcooL/httpfs v0.0.0-20190707220628-8d4bc4ba7749 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+)
@@ -107,9 +107,8 @@ func RouteStopped(r chi.Router, runOpts *options.ServerConfig) {
 					return
 				}
 
-				oldID := webhooks.URLSafeGitID(chi.URLParam(r, "oldID"))
 				// TODO add `since`
-				j, err := jobs.LoadLogs(runOpts, oldID)
+				j, err := jobs.LoadLogs(runOpts, chi.URLParam(r, "oldID"))
 				if nil != err {
 					w.WriteHeader(http.StatusNotFound)
 					w.Write([]byte(
@@ -120,8 +119,12 @@ func RouteStopped(r chi.Router, runOpts *options.ServerConfig) {
 
 				// copies unused lock value
 				jobCopy := *j
+				stage := r.URL.Query().Get("stage")
 				logs := []jobs.Log{}
 				for _, log := range j.Logs {
+					if "" != stage && stage != log.Stage {
+						continue
+					}
 					if log.Timestamp.Sub(since) > 0 {
 						logs = append(logs, log)
 					}
@@ -141,6 +144,22 @@ func RouteStopped(r chi.Router, runOpts *options.ServerConfig) {
 				w.Write(append(b, '\n'))
 			})
 
+			r.Get("/artifacts/{jobID}/*", func(w http.ResponseWriter, r *http.Request) {
+				artifactPath, err := jobs.ArtifactPath(runOpts, chi.URLParam(r, "jobID"), chi.URLParam(r, "*"))
+				if nil != err {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusNotFound)
+					writeError(w, &HTTPError{
+						Code:    "E_ARTIFACT",
+						Message: err.Error(),
+					})
+					return
+				}
+
+				// TODO admin auth middleware
+				http.ServeFile(w, r, artifactPath)
+			})
+
 			/*
 				r.Get("/logs/*", func(w http.ResponseWriter, r *http.Request) {
 					// TODO add ?since=
@@ -190,17 +209,332 @@ func RouteStopped(r chi.Router, runOpts *options.ServerConfig) {
 					return
 				}
 
-				if _, ok := jobs.Actives.Load(webhooks.URLSafeRefID(msg.JobID)); !ok {
-					if _, ok := jobs.Pending.Load(webhooks.URLSafeRefID(msg.JobID)); !ok {
-						w.Write([]byte(
-							`{ "success": false, "error": "job does not exist" }` + "\n",
-						))
-						return
-					}
+				// TODO admin auth middleware
+				if refID, ok := jobs.FindPending(msg.JobID); ok {
+					// it hasn't started, so there's nothing to kill
+					jobs.Cancel(runOpts, refID)
+					w.Write([]byte(
+						`{ "success": true }` + "\n",
+					))
+					return
+				}
+
+				refID, ok := jobs.FindRefID(msg.JobID)
+				if !ok {
+					w.Write([]byte(
+						`{ "success": false, "error": "job does not exist" }` + "\n",
+					))
+					return
 				}
 
 				// killing a job *should* always succeed ...right?
-				jobs.Remove(webhooks.URLSafeRefID(msg.JobID))
+				jobs.Remove(refID)
+				w.Write([]byte(
+					`{ "success": true }` + "\n",
+				))
+			})
+
+			r.Get("/queue", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				b, _ := json.Marshal(struct {
+					Success bool        `json:"success"`
+					Jobs    []*jobs.Job `json:"jobs"`
+				}{
+					Success: true,
+					Jobs:    jobs.Queue(),
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Post("/queue/{action:cancel|bump}", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				decoder := json.NewDecoder(r.Body)
+				msg := &QueueMsg{}
+				if err := decoder.Decode(msg); nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "could not parse request body",
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				// TODO admin auth middleware
+				refID, ok := jobs.FindPending(msg.JobID)
+				if ok {
+					if "bump" == chi.URLParam(r, "action") {
+						ok = jobs.Bump(refID)
+					} else {
+						ok = jobs.Cancel(runOpts, refID)
+					}
+				}
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					writeError(w, &HTTPError{
+						Code:    "E_NOT_PENDING",
+						Message: fmt.Sprintf("job %q is not pending", msg.JobID),
+					})
+					return
+				}
+
+				w.Write([]byte(
+					`{ "success": true }` + "\n",
+				))
+			})
+
+			r.Post("/queue/flush", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				// TODO admin auth middleware
+				b, _ := json.Marshal(struct {
+					Success  bool `json:"success"`
+					Canceled int  `json:"canceled"`
+				}{
+					Success:  true,
+					Canceled: jobs.Flush(runOpts),
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Post("/deploy", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				decoder := json.NewDecoder(r.Body)
+				msg := &DeployMsg{}
+				if err := decoder.Decode(msg); nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "could not parse request body",
+						Detail:  err.Error(),
+					})
+					return
+				}
+				if "" == msg.RepoID || "" == msg.RefName {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "'repo_id' and 'ref_name' are required",
+					})
+					return
+				}
+				if "" != msg.RefType && "branch" != msg.RefType && "tag" != msg.RefType {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "'ref_type' must be 'branch' or 'tag'",
+					})
+					return
+				}
+
+				hook, err := jobs.ResolveRef(runOpts, msg.RepoID, msg.RefName, msg.RefType, msg.Rev)
+				if nil != err {
+					status := http.StatusUnprocessableEntity
+					if jobs.ErrUnknownRepo == err {
+						status = http.StatusNotFound
+					}
+					w.WriteHeader(status)
+					writeError(w, &HTTPError{
+						Code:    "E_RESOLVE",
+						Message: fmt.Sprintf("could not deploy %s#%s", msg.RepoID, msg.RefName),
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				inputs, err := jobs.ResolveInputs(hook.RepoID, msg.Inputs)
+				if nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_INPUT",
+						Message: "invalid inputs",
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				// TODO admin auth middleware
+				// (until then, triggered_by is whatever the client says it is)
+				triggeredBy := msg.TriggeredBy
+				if "" == triggeredBy {
+					triggeredBy = r.RemoteAddr
+				}
+				job := jobs.Deploy(hook, triggeredBy, inputs, msg.Now)
+
+				b, _ := json.Marshal(struct {
+					Success bool      `json:"success"`
+					Job     *jobs.Job `json:"job"`
+				}{
+					Success: true,
+					Job:     job,
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Post("/rollback", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				decoder := json.NewDecoder(r.Body)
+				msg := &RollbackMsg{}
+				if err := decoder.Decode(msg); nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "could not parse request body",
+						Detail:  err.Error(),
+					})
+					return
+				}
+				revID, err := jobs.ParseRevID(msg.RevID)
+				if nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "'rev_id' is required",
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				replay, err := jobs.FindDeployed(runOpts, revID, msg.Force)
+				if nil != err {
+					status := http.StatusNotFound
+					if jobs.ErrRevFailed == err {
+						status = http.StatusConflict
+					}
+					w.WriteHeader(status)
+					writeError(w, &HTTPError{
+						Code:    "E_ROLLBACK",
+						Message: fmt.Sprintf("could not roll back to %s", revID),
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				// TODO admin auth middleware
+				// (until then, triggered_by is whatever the client says it is)
+				triggeredBy := msg.TriggeredBy
+				if "" == triggeredBy {
+					triggeredBy = r.RemoteAddr
+				}
+				job := jobs.Rollback(replay, triggeredBy, msg.Now)
+
+				b, _ := json.Marshal(struct {
+					Success bool      `json:"success"`
+					Job     *jobs.Job `json:"job"`
+				}{
+					Success: true,
+					Job:     job,
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Get("/usage", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				b, _ := json.Marshal(struct {
+					Success bool              `json:"success"`
+					Repos   []*jobs.RepoUsage `json:"repos"`
+				}{
+					Success: true,
+					Repos:   jobs.UsageByRepo(),
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Get("/paused", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				b, _ := json.Marshal(struct {
+					Success bool           `json:"success"`
+					Paused  []*jobs.Paused `json:"paused"`
+				}{
+					Success: true,
+					Paused:  jobs.ListPaused(),
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Post("/pause", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				decoder := json.NewDecoder(r.Body)
+				msg := &PauseMsg{}
+				if err := decoder.Decode(msg); nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "could not parse request body",
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				// TODO admin auth middleware
+				pausedBy := msg.PausedBy
+				if "" == pausedBy {
+					pausedBy = r.RemoteAddr
+				}
+				paused, err := jobs.Pause(runOpts, msg.RepoID, pausedBy, msg.Reason)
+				if jobs.ErrUnknownRepo == err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "'repo_id' should be a repo, ex: github.com/org/repo (or empty for every repo)",
+					})
+					return
+				}
+				if nil != err {
+					// still paused, but won't be after a restart
+					log.Printf("[warn] could not save pause: %v", err)
+				}
+
+				b, _ := json.Marshal(struct {
+					Success bool         `json:"success"`
+					Paused  *jobs.Paused `json:"paused"`
+				}{
+					Success: true,
+					Paused:  paused,
+				})
+				w.Write(append(b, '\n'))
+			})
+
+			r.Post("/resume", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				decoder := json.NewDecoder(r.Body)
+				msg := &PauseMsg{}
+				if err := decoder.Decode(msg); nil != err {
+					w.WriteHeader(http.StatusBadRequest)
+					writeError(w, &HTTPError{
+						Code:    "E_PARSE",
+						Message: "could not parse request body",
+						Detail:  err.Error(),
+					})
+					return
+				}
+
+				// TODO admin auth middleware
+				err := jobs.Resume(runOpts, msg.RepoID)
+				if jobs.ErrNotPaused == err {
+					message := "deploys are not paused"
+					if "" != msg.RepoID {
+						message = fmt.Sprintf("%s is not paused", msg.RepoID)
+					}
+					w.WriteHeader(http.StatusNotFound)
+					writeError(w, &HTTPError{
+						Code:    "E_NOT_PAUSED",
+						Message: message,
+					})
+					return
+				}
+				if nil != err {
+					log.Printf("[warn] could not save resume: %v", err)
+				}
+
 				w.Write([]byte(
 					`{ "success": true }` + "\n",
 				))
@@ -284,7 +618,7 @@ func RouteStopped(r chi.Router, runOpts *options.ServerConfig) {
 					}
 				}
 
-				jobID := webhooks.URLSafeRefID(chi.URLParam(r, "jobID"))
+				jobID := chi.URLParam(r, "jobID")
 				if err := jobs.SetReport(jobID, &report.Report); nil != err {
 					w.WriteHeader(http.StatusInternalServerError)
 					writeError(w, &HTTPError{
@@ -373,6 +707,38 @@ type Repo struct {
 	Promotions []string `json:"_promotions"`
 }
 
+// DeployMsg describes a manual deploy
+type DeployMsg struct {
+	RepoID      string `json:"repo_id"`
+	RefName     string `json:"ref_name"`
+	RefType     string `json:"ref_type,omitempty"`     // branch (default) or tag
+	Rev         string `json:"rev,omitempty"`          // the latest rev of the ref when empty
+	Now         bool   `json:"now,omitempty"`          // skip the debounce
+	TriggeredBy string `json:"triggered_by,omitempty"` // as the client says (unauthenticated), or its address when empty
+	// the values for the repo's declared inputs, ex: { "clear_cache": true }
+	Inputs map[string]interface{} `json:"inputs,omitempty"`
+}
+
+// RollbackMsg describes which earlier deploy to run again
+type RollbackMsg struct {
+	RevID       string `json:"rev_id"`                 // ex: github.com/org/project#abc1234, or its URL-safe id
+	Force       bool   `json:"force,omitempty"`        // even if the rev never deployed successfully
+	Now         bool   `json:"now,omitempty"`          // skip the debounce
+	TriggeredBy string `json:"triggered_by,omitempty"` // as the client says (unauthenticated), or its address when empty
+}
+
+// PauseMsg describes which repo to pause or resume
+type PauseMsg struct {
+	RepoID   string `json:"repo_id,omitempty"`   // every repo when empty
+	Reason   string `json:"reason,omitempty"`    // shown as each held job's wait_reason
+	PausedBy string `json:"paused_by,omitempty"` // the client address when empty
+}
+
+// QueueMsg describes which pending job to cancel or bump
+type QueueMsg struct {
+	JobID string `json:"job_id"` // or the URL-safe base64 of its RefID
+}
+
 // KillMsg describes which job to kill
 type KillMsg struct {
 	JobID string `json:"job_id"`
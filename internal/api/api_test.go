@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,7 +32,7 @@ func init() {
 		//Addr:          "localhost:4483",
 		ScriptsPath:       "./testdata",
 		LogDir:            "./test-logs/api",
-		TmpDir:            tmpDir,
+		BacklogDir:        tmpDir,
 		DebounceDelay:     25 * time.Millisecond,
 		DefaultMaxJobTime: 5 * time.Second, // very short
 		StaleJobAge:       5 * time.Minute,
@@ -137,3 +138,124 @@ func TestCallback(t *testing.T) {
 		return
 	}
 }
+
+func TestDeploy(t *testing.T) {
+	// known from TestCallback
+	rev := "ab12cd34ef"
+	reqURL := fmt.Sprintf("http://%s/api/admin/deploy", runOpts.Addr)
+	resp, err := http.Post(reqURL, "application/json", strings.NewReader(`{
+		"repo_id": "git.example.com/owner/repo",
+		"ref_name": "master",
+		"rev": "`+rev+`",
+		"now": true,
+		"triggered_by": "tester"
+	}`))
+	if nil != err {
+		t.Fatalf("HTTP response error: %s\n%#v", reqURL, err)
+	}
+	if http.StatusOK != resp.StatusCode {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("should accept the deploy: %d %s", resp.StatusCode, string(b))
+	}
+
+	t.Log("sleep so job can finish")
+	time.Sleep(jobDelay)
+	time.Sleep(jobDelay)
+
+	value, ok := jobs.Recents.Load(webhooks.RevID("git.example.com/owner/repo#" + rev))
+	if !ok {
+		t.Fatalf("should have run the manual deploy")
+	}
+	job := value.(*jobs.Job)
+	if jobs.TriggerManual != job.Trigger || "tester" != job.TriggeredBy {
+		t.Errorf("should record the manual trigger, not %q by %q", job.Trigger, job.TriggeredBy)
+	}
+	if "https://git.example.com/owner/repo.git" != job.GitRef.HTTPSURL {
+		t.Errorf("should resolve the clone url, not %q", job.GitRef.HTTPSURL)
+	}
+
+	resp, err = http.Post(reqURL, "application/json", strings.NewReader(`{
+		"repo_id": "git.example.com/nobody/nothing",
+		"ref_name": "master",
+		"rev": "`+rev+`"
+	}`))
+	if nil != err {
+		t.Fatalf("HTTP response error: %s\n%#v", reqURL, err)
+	}
+	if http.StatusNotFound != resp.StatusCode {
+		t.Errorf("should not deploy an unknown repo, got %d", resp.StatusCode)
+	}
+}
+
+func TestCancelPending(t *testing.T) {
+	baseURL := fmt.Sprintf("http://%s/api/admin", runOpts.Addr)
+	post := func(path, body string) *http.Response {
+		resp, err := http.Post(baseURL+path, "application/json", strings.NewReader(body))
+		if nil != err {
+			t.Fatalf("HTTP response error: %s\n%#v", baseURL+path, err)
+		}
+		return resp
+	}
+
+	resp := post("/pause", `{ "repo_id": "git.example.com/owner/repo", "reason": "testing", "paused_by": "tester" }`)
+	if http.StatusOK != resp.StatusCode {
+		t.Fatalf("should pause the repo, got %d", resp.StatusCode)
+	}
+
+	// known from TestCallback
+	rev := "ab12cd3400"
+	resp = post("/deploy", `{
+		"repo_id": "git.example.com/owner/repo",
+		"ref_name": "master",
+		"rev": "`+rev+`",
+		"now": true
+	}`)
+	deployed := struct {
+		Job *jobs.Job `json:"job"`
+	}{}
+	_ = json.NewDecoder(resp.Body).Decode(&deployed)
+	if nil == deployed.Job {
+		t.Fatalf("should accept the deploy, got %d", resp.StatusCode)
+	}
+
+	t.Log("wait for the job to be held")
+	time.Sleep(jobDelay)
+	queued := struct {
+		Jobs []*jobs.Job `json:"jobs"`
+	}{}
+	resp, err := http.Get(baseURL + "/queue")
+	if nil != err {
+		t.Fatal(err)
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&queued)
+	if 1 != len(queued.Jobs) || deployed.Job.ID != queued.Jobs[0].ID {
+		t.Fatalf("should have queued the deploy: %#v", queued.Jobs)
+	}
+	if "git.example.com/owner/repo is paused by tester: testing" != queued.Jobs[0].WaitReason {
+		t.Errorf("should show why it's held, not %q", queued.Jobs[0].WaitReason)
+	}
+
+	resp = post("/jobs", `{ "job_id": "`+deployed.Job.ID+`", "kill": true }`)
+	b, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(b), `"success": true`) {
+		t.Fatalf("should cancel the pending job: %s", string(b))
+	}
+	resp = post("/queue/cancel", `{ "job_id": "`+deployed.Job.ID+`" }`)
+	if http.StatusNotFound != resp.StatusCode {
+		t.Errorf("should not cancel twice, got %d", resp.StatusCode)
+	}
+
+	resp = post("/resume", `{ "repo_id": "git.example.com/owner/repo" }`)
+	if http.StatusOK != resp.StatusCode {
+		t.Fatalf("should resume the repo, got %d", resp.StatusCode)
+	}
+	resp = post("/resume", `{ "repo_id": "git.example.com/owner/repo" }`)
+	if http.StatusNotFound != resp.StatusCode {
+		t.Errorf("should not resume twice, got %d", resp.StatusCode)
+	}
+
+	time.Sleep(jobDelay)
+	if _, ok := jobs.Recents.Load(webhooks.RevID("git.example.com/owner/repo#" + rev)); ok {
+		t.Errorf("should not have run the canceled deploy")
+	}
+}
@@ -0,0 +1,355 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+)
+
+// RepoConfig is the optional config.json that sits next to a repo's deploy.sh
+// in the scripts directory, ex: scripts/github.com/org/repo/config.json
+type RepoConfig struct {
+	// Locks name shared resources, such as "www-root" or "prod-db".
+	// Two jobs that hold the same lock will never run at the same time.
+	Locks []string `json:"locks,omitempty"`
+	// Supersede kills a running job as soon as a newer push
+	// to the same ref arrives, and starts the newer one right away
+	Supersede bool `json:"supersede,omitempty"`
+	// MaxJobTime overrides the server's max job time for this repo
+	MaxJobTime Duration `json:"max_job_time,omitempty"`
+	// IdleTimeout kills a job that hasn't written to stdout
+	// or stderr for this long (ex: stuck on a prompt)
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	// Retry runs a failed job again, after a backoff
+	Retry *RetryConfig `json:"retry,omitempty"`
+	// Debounce overrides how the repo's pushes are debounced
+	Debounce *DebounceConfig `json:"debounce,omitempty"`
+	// Inputs are the parameters that a manual deploy may be given
+	Inputs []Input `json:"inputs,omitempty"`
+	// Stages are run in order, each as its own run of deploy.sh
+	// (none means that deploy.sh is run once, as a single step)
+	Stages []StageConfig `json:"stages,omitempty"`
+	// Downstream deploys other refs after this repo's refs deploy successfully
+	Downstream []DownstreamConfig `json:"downstream,omitempty"`
+	// Schedules deploy the repo's refs at set times, even without a push
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+	// Freezes hold back the repo's deploys for a while (see also FreezesFile)
+	Freezes []FreezeWindow `json:"freezes,omitempty"`
+	// Priorities put the repo's jobs in a priority class (see also PrioritiesFile)
+	Priorities []PriorityRule `json:"priorities,omitempty"`
+}
+
+// Input types
+const (
+	InputString  = "string"
+	InputBoolean = "boolean"
+	InputNumber  = "number"
+)
+
+// Input is a parameter for a manual deploy,
+// passed to the script as GIT_DEPLOY_INPUT_<NAME>
+type Input struct {
+	Name string `json:"name"`
+	// Type is string (default), boolean, or number
+	Type string `json:"type,omitempty"`
+	// Default is used when no value is given.
+	// An input without a default is required.
+	Default interface{} `json:"default,omitempty"`
+	// Options are the allowed values (any value when empty)
+	Options []interface{} `json:"options,omitempty"`
+}
+
+var inputNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validate checks that the config's inputs, stages, downstream triggers,
+// schedules, freezes, and priorities make sense
+func (conf *RepoConfig) validate() error {
+	if err := validateStages(conf.Stages); nil != err {
+		return err
+	}
+	if err := validateDownstream(conf.Downstream); nil != err {
+		return err
+	}
+	if err := validateSchedules(conf.Schedules); nil != err {
+		return err
+	}
+	if err := validateFreezes(conf.Freezes); nil != err {
+		return err
+	}
+	if err := validatePriorities(conf.Priorities); nil != err {
+		return err
+	}
+	for _, rule := range conf.Priorities {
+		if len(rule.Repos) > 0 {
+			return fmt.Errorf("priority %q should leave out repos (it's only for this repo)", rule.Class)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := range conf.Inputs {
+		input := &conf.Inputs[i]
+		if !inputNameRe.MatchString(input.Name) {
+			return fmt.Errorf("input name %q should be letters, digits, and underscores", input.Name)
+		}
+		if seen[strings.ToUpper(input.Name)] {
+			return fmt.Errorf("input %q is declared twice", input.Name)
+		}
+		seen[strings.ToUpper(input.Name)] = true
+
+		switch input.Type {
+		case "":
+			input.Type = InputString
+		case InputString, InputBoolean, InputNumber:
+			// ok
+		default:
+			return fmt.Errorf("input %q has unknown type %q", input.Name, input.Type)
+		}
+		for _, opt := range input.Options {
+			if _, err := input.parse(opt); nil != err {
+				return fmt.Errorf("input %q has an invalid option: %v", input.Name, err)
+			}
+		}
+		if nil != input.Default {
+			if _, err := input.check(input.Default); nil != err {
+				return fmt.Errorf("input %q has an invalid default: %v", input.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveInputs checks the given values against the repo's inputs,
+// fills in the defaults, and returns each value as a string
+func ResolveInputs(repoID string, given map[string]interface{}) (map[string]string, error) {
+	return getRepoConfig(repoID).resolveInputs(given)
+}
+
+func (conf *RepoConfig) resolveInputs(given map[string]interface{}) (map[string]string, error) {
+	inputs := map[string]string{}
+	found := map[string]bool{}
+	for i := range conf.Inputs {
+		input := &conf.Inputs[i]
+		val, ok := given[input.Name]
+		if ok {
+			found[input.Name] = true
+		} else {
+			val = input.Default
+		}
+		if nil == val {
+			return nil, fmt.Errorf("input %q is required", input.Name)
+		}
+		str, err := input.check(val)
+		if nil != err {
+			return nil, fmt.Errorf("input %q: %v", input.Name, err)
+		}
+		inputs[input.Name] = str
+	}
+	for name := range given {
+		if !found[name] {
+			return nil, fmt.Errorf("unknown input %q", name)
+		}
+	}
+	return inputs, nil
+}
+
+// defaultInputs are the inputs for a deploy that wasn't given any,
+// leaving out those that are required
+func (conf *RepoConfig) defaultInputs() map[string]string {
+	if 0 == len(conf.Inputs) {
+		return nil
+	}
+	inputs := map[string]string{}
+	for i := range conf.Inputs {
+		input := &conf.Inputs[i]
+		if nil == input.Default {
+			continue
+		}
+		if str, err := input.parse(input.Default); nil == err {
+			inputs[input.Name] = str
+		}
+	}
+	return inputs
+}
+
+// check parses the value and makes sure it's one of the options
+func (input *Input) check(val interface{}) (string, error) {
+	str, err := input.parse(val)
+	if nil != err {
+		return "", err
+	}
+	if 0 == len(input.Options) {
+		return str, nil
+	}
+	for _, opt := range input.Options {
+		if optStr, _ := input.parse(opt); optStr == str {
+			return str, nil
+		}
+	}
+	return "", fmt.Errorf("%q is not one of the options", str)
+}
+
+// parse accepts the input's type, or a string of it (as from the command line)
+func (input *Input) parse(val interface{}) (string, error) {
+	switch input.Type {
+	case InputBoolean:
+		switch v := val.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			if b, err := strconv.ParseBool(v); nil == err {
+				return strconv.FormatBool(b), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not a boolean", val)
+	case InputNumber:
+		switch v := val.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); nil == err {
+				return strconv.FormatFloat(f, 'f', -1, 64), nil
+			}
+		}
+		return "", fmt.Errorf("%v is not a number", val)
+	default:
+		if v, ok := val.(string); ok {
+			return v, nil
+		}
+		return "", fmt.Errorf("%v is not a string", val)
+	}
+}
+
+// InputEnv is the name of the input's ENV, ex: GIT_DEPLOY_INPUT_CLEAR_CACHE
+func InputEnv(name string) string {
+	return "GIT_DEPLOY_INPUT_" + strings.ToUpper(name)
+}
+
+// RetryConfig is how (and whether) a failed job is retried
+type RetryConfig struct {
+	// MaxAttempts counts the first run, so 3 means up to 2 retries
+	MaxAttempts int `json:"max_attempts"`
+	// Backoff is the wait before the first retry, and doubles for each one after
+	Backoff Duration `json:"backoff,omitempty"`
+	// MaxBackoff caps the doubled wait
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+	// ExitCodes limits retries to these exit codes (any failure when empty)
+	ExitCodes []int `json:"exit_codes,omitempty"`
+}
+
+// DebounceConfig is how a burst of pushes to the same ref becomes one job
+type DebounceConfig struct {
+	// Delay is how long to wait after each push for another (the server's debounce delay when empty)
+	Delay Duration `json:"delay,omitempty"`
+	// MaxWait runs the job once this long has passed since the first push
+	// of a burst, even if pushes keep coming
+	MaxWait Duration `json:"max_wait,omitempty"`
+	// Leading runs the first push after a quiet spell right away,
+	// and then debounces the pushes that follow it
+	Leading bool `json:"leading,omitempty"`
+	// MinInterval is the least time from the end of a successful deploy
+	// of a ref to the start of its next one
+	MinInterval Duration `json:"min_interval,omitempty"`
+}
+
+// Duration reads from JSON as either a string, such as "90s" or "5m",
+// or a number of seconds
+type Duration time.Duration
+
+// UnmarshalJSON parses "90s" or 90 as 90 seconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); nil != err {
+		return err
+	}
+
+	switch val := v.(type) {
+	case float64:
+		*d = Duration(val * float64(time.Second))
+	case string:
+		dur, err := time.ParseDuration(val)
+		if nil != err {
+			return err
+		}
+		*d = Duration(dur)
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
+
+// MarshalJSON writes the duration as a string, such as "1m30s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var repoConfigsMux sync.RWMutex
+
+// map[lowercase RepoID]*RepoConfig
+var repoConfigs = make(map[string]*RepoConfig)
+
+// LoadRepoConfigs reads every scripts/{repo_id}/config.json,
+// and fails on the first that can't be parsed or is invalid
+func LoadRepoConfigs(runOpts *options.ServerConfig) (map[string]*RepoConfig, error) {
+	configs := make(map[string]*RepoConfig)
+	if 0 == len(runOpts.ScriptsPath) {
+		return configs, nil
+	}
+
+	scriptsPath, _ := filepath.Abs(runOpts.ScriptsPath)
+	err := filepath.Walk(scriptsPath, func(configPath string, info os.FileInfo, err error) error {
+		if nil != err {
+			log.Printf("[warn] failed to walk scripts dir: %v", err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || "config.json" != info.Name() {
+			return nil
+		}
+
+		// "github.com/org/repo"
+		repoID := filepath.ToSlash(filepath.Dir(configPath[len(scriptsPath):]))
+		repoID = strings.Trim(repoID, "/")
+		if len(strings.Split(repoID, "/")) < 3 {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(configPath)
+		if nil != err {
+			return err
+		}
+		conf := &RepoConfig{}
+		if err := json.Unmarshal(b, conf); nil != err {
+			return fmt.Errorf("could not parse %s: %v", configPath, err)
+		}
+		if err := conf.validate(); nil != err {
+			return fmt.Errorf("invalid %s: %v", configPath, err)
+		}
+		configs[strings.ToLower(repoID)] = conf
+		return nil
+	})
+	if nil != err {
+		return configs, err
+	}
+
+	return configs, findDownstreamLoop(configs)
+}
+
+// getRepoConfig returns the repo's config, or an empty config if it has none
+func getRepoConfig(repoID string) *RepoConfig {
+	repoConfigsMux.RLock()
+	defer repoConfigsMux.RUnlock()
+
+	if conf, ok := repoConfigs[strings.ToLower(repoID)]; ok {
+		return conf
+	}
+	return &RepoConfig{}
+}
@@ -0,0 +1,220 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// What started a job
+const (
+	TriggerWebhook  = "webhook"
+	TriggerManual   = "manual"
+	TriggerRollback = "rollback" // a manual deploy that replays an earlier job
+	TriggerUpstream = "upstream" // another ref deployed successfully (see DownstreamConfig)
+	TriggerSchedule = "schedule" // the repo's schedule came (see ScheduleConfig)
+)
+
+// ErrUnknownRepo means that a manual deploy was asked for a repo
+// that isn't trusted, has no deploy script, and has never been deployed
+var ErrUnknownRepo = errors.New("unknown repo")
+
+// ErrUnknownRev means that the rev wasn't given and couldn't be looked up
+var ErrUnknownRev = errors.New("could not resolve rev")
+
+// lsRemoteTimeout limits how long looking up a rev may take
+const lsRemoteTimeout = 15 * time.Second
+
+type deployment struct {
+	job *Job
+	now bool
+}
+
+var deployments = make(chan deployment)
+
+// Deploy puts a job that didn't come from a webhook in the queue,
+// with inputs that have already been resolved (see ResolveInputs).
+// When now is true it skips the debounce (but still waits its turn).
+// It returns the pending job, as it was queued (a push to the same ref
+// before it runs changes its rev, but not its ID, see webhookJob).
+func Deploy(hook *webhooks.Ref, triggeredBy string, inputs map[string]string, now bool) *Job {
+	pending := &Job{
+		ID:          NewJobID(),
+		GitRef:      hook,
+		Status:      StatusPending,
+		Trigger:     TriggerManual,
+		TriggeredBy: triggeredBy,
+		Inputs:      inputs,
+	}
+	deployments <- deployment{
+		job: &Job{
+			ID:          pending.ID,
+			GitRef:      pending.GitRef,
+			Trigger:     pending.Trigger,
+			TriggeredBy: pending.TriggeredBy,
+			Inputs:      pending.Inputs,
+		},
+		now: now,
+	}
+	return pending
+}
+
+// webhookJob is the pending job for a push, in place of the job that's
+// already pending for its ref. A pending manual deploy stays the same job
+// (as Deploy returned it) with the pushed rev, and a pending rollback keeps
+// the rev that it rolls back to, with the push queued behind it (see start).
+func webhookJob(hook *webhooks.Ref) *Job {
+	value, ok := Pending.Load(hook.GetRefID())
+	if !ok {
+		return &Job{GitRef: hook, Trigger: TriggerWebhook}
+	}
+	pending := value.(*Job)
+	switch pending.Trigger {
+	case TriggerRollback:
+		return &Job{
+			ID:          pending.ID,
+			GitRef:      pending.GitRef,
+			Trigger:     pending.Trigger,
+			TriggeredBy: pending.TriggeredBy,
+			Inputs:      pending.Inputs,
+			RollbackOf:  pending.RollbackOf,
+			NextPush:    hook,
+		}
+	case TriggerManual:
+		return &Job{
+			ID:          pending.ID,
+			GitRef:      hook,
+			Trigger:     pending.Trigger,
+			TriggeredBy: pending.TriggeredBy,
+			Inputs:      pending.Inputs,
+		}
+	}
+	return &Job{GitRef: hook, Trigger: TriggerWebhook}
+}
+
+// ResolveRef builds the ref for a manual deploy from a known repo.
+// When rev is empty it's looked up with 'git ls-remote', or else
+// is the last rev that was seen for the ref.
+func ResolveRef(runOpts *options.ServerConfig, repoID, refName, refType, rev string) (*webhooks.Ref, error) {
+	repoID = strings.Trim(repoID, "/")
+	if len(strings.Split(repoID, "/")) < 3 || "" == refName {
+		return nil, ErrUnknownRepo
+	}
+	if "" == refType {
+		refType = "branch"
+	}
+	ref := "refs/heads/" + refName
+	if "tag" == refType {
+		ref = "refs/tags/" + refName
+	}
+
+	hook := &webhooks.Ref{
+		RepoID:   repoID,
+		HTTPSURL: fmt.Sprintf("https://%s.git", repoID),
+		Rev:      rev,
+		Ref:      ref,
+		RefType:  refType,
+		RefName:  refName,
+		Owner:    path.Base(path.Dir(repoID)),
+		Repo:     path.Base(repoID),
+	}
+	last, known := lastKnownRef(hook)
+	if nil != last {
+		// the provider's own clone urls
+		hook.HTTPSURL = last.HTTPSURL
+		hook.SSHURL = last.SSHURL
+		hook.RepoID = last.RepoID
+		hook.Owner = last.Owner
+		hook.Repo = last.Repo
+	}
+	if nil == last && !isKnownRepo(runOpts, repoID) {
+		return nil, ErrUnknownRepo
+	}
+
+	if "" == hook.Rev {
+		hook.Rev = lsRemote(hook.HTTPSURL, ref)
+	}
+	if "" == hook.Rev && nil != known {
+		hook.Rev = known.Rev
+	}
+	if "" == hook.Rev {
+		return nil, ErrUnknownRev
+	}
+
+	return webhooks.New(*hook), nil
+}
+
+// lastKnownRef returns the newest ref seen for the repo and,
+// if there is one, the newest seen for the same branch or tag
+func lastKnownRef(hook *webhooks.Ref) (*webhooks.Ref, *webhooks.Ref) {
+	var last, known *webhooks.Ref
+	find := func(key, value interface{}) bool {
+		job := value.(*Job)
+		ref := job.GitRef
+		if !strings.EqualFold(hook.RepoID, ref.RepoID) {
+			return true
+		}
+		if nil == last || ref.Timestamp.After(last.Timestamp) {
+			last = ref
+		}
+		if hook.RefName == ref.RefName && (nil == known || ref.Timestamp.After(known.Timestamp)) {
+			known = ref
+		}
+		return true
+	}
+	Recents.Range(find)
+	Actives.Range(find)
+	Pending.Range(find)
+	return last, known
+}
+
+// isKnownRepo is true for a trusted repo, or one with its own deploy script
+func isKnownRepo(runOpts *options.ServerConfig, repoID string) bool {
+	if isTrusted(runOpts.RepoList, repoID) {
+		return true
+	}
+
+	if "" == runOpts.ScriptsPath {
+		return false
+	}
+	repoID = strings.ToLower(repoID)
+	scriptPath := filepath.Join(runOpts.ScriptsPath, filepath.FromSlash(repoID), "deploy.sh")
+	if info, err := os.Stat(scriptPath); nil == err && info.Mode().IsRegular() {
+		return true
+	}
+
+	repoConfigsMux.RLock()
+	defer repoConfigsMux.RUnlock()
+	_, ok := repoConfigs[repoID]
+	return ok
+}
+
+// lsRemote returns the rev of the remote ref, or empty if it can't be found
+func lsRemote(cloneURL, ref string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), lsRemoteTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--", cloneURL, ref)
+	// never wait on a password prompt
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if nil != err {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if 2 == len(fields) && ref == fields[1] {
+			return fields[0]
+		}
+	}
+	return ""
+}
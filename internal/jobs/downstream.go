@@ -0,0 +1,157 @@
+package jobs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+)
+
+// DownstreamConfig deploys a ref of another repo (or of the same repo)
+// each time a ref of this repo deploys successfully
+type DownstreamConfig struct {
+	// After is this repo's branch or tag, ex: main
+	After string `json:"after"`
+	// Deploy is the RefID to deploy, ex: github.com/acme/docs#main
+	Deploy string `json:"deploy"`
+	// RefType is the type of the ref to deploy, branch (default) or tag
+	RefType string `json:"ref_type,omitempty"`
+}
+
+// split is the repo and ref name to deploy
+func (down *DownstreamConfig) split() (string, string) {
+	i := strings.LastIndex(down.Deploy, "#")
+	if i < 0 {
+		return down.Deploy, ""
+	}
+	return strings.Trim(down.Deploy[:i], "/"), down.Deploy[i+1:]
+}
+
+// validateDownstream checks that each trigger names a ref to deploy
+func validateDownstream(downstream []DownstreamConfig) error {
+	for _, down := range downstream {
+		if "" == down.After {
+			return fmt.Errorf("downstream %q should say which ref it comes after", down.Deploy)
+		}
+		repoID, refName := down.split()
+		if len(strings.Split(repoID, "/")) < 3 || "" == refName {
+			return fmt.Errorf("downstream %q should be a repo and ref, ex: github.com/org/repo#main", down.Deploy)
+		}
+		if "" != down.RefType && "branch" != down.RefType && "tag" != down.RefType {
+			return fmt.Errorf("downstream %q has unknown ref_type %q", down.Deploy, down.RefType)
+		}
+	}
+	return nil
+}
+
+// findDownstreamLoop returns an error that shows the first loop of downstream
+// triggers (ex: a#main -> b#main -> a#main), as that would deploy forever
+func findDownstreamLoop(configs map[string]*RepoConfig) error {
+	// map[lowercase repo#ref][]lowercase repo#ref
+	edges := map[string][]string{}
+	for repoID, conf := range configs {
+		for _, down := range conf.Downstream {
+			downRepoID, refName := down.split()
+			from := strings.ToLower(repoID) + "#" + down.After
+			edges[from] = append(edges[from], strings.ToLower(downRepoID)+"#"+refName)
+		}
+	}
+	froms := []string{}
+	for from := range edges {
+		froms = append(froms, from)
+	}
+	// the same loop is reported the same way each time
+	sort.Strings(froms)
+
+	const (
+		unseen = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(node string) error
+	visit = func(node string) error {
+		switch state[node] {
+		case visiting:
+			for i := range path {
+				if node == path[i] {
+					return fmt.Errorf("downstream triggers loop: %s", strings.Join(append(path[i:], node), " -> "))
+				}
+			}
+			return nil
+		case done:
+			return nil
+		}
+		state[node] = visiting
+		path = append(path, node)
+		for _, next := range edges[node] {
+			if err := visit(next); nil != err {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[node] = done
+		return nil
+	}
+	for _, from := range froms {
+		if err := visit(from); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// triggerDownstream queues the refs that come after the job's ref,
+// which has just deployed successfully (jobsTimersMux must be held)
+func triggerDownstream(job *Job, runOpts *options.ServerConfig) {
+	hook := job.GitRef
+	for _, down := range getRepoConfig(hook.RepoID).Downstream {
+		if down.After != hook.RefName {
+			continue
+		}
+		repoID, refName := down.split()
+		down := down
+		// looking up the rev can take a while
+		go func() {
+			downHook, err := ResolveRef(runOpts, repoID, refName, down.RefType, "")
+			if nil != err {
+				log.Printf("[%s] could not deploy downstream %s: %v", hook.GetRefID(), down.Deploy, err)
+				return
+			}
+			log.Printf("[%s] deploying downstream %s", hook.GetRefID(), downHook.GetRefID())
+			deployments <- deployment{
+				job: &Job{
+					ID:         NewJobID(),
+					GitRef:     downHook,
+					Trigger:    TriggerUpstream,
+					Upstream:   hook,
+					UpstreamID: job.ID,
+				},
+			}
+		}()
+	}
+}
+
+// upstreamEnvs tell a downstream job's script what deployed before it
+func upstreamEnvs(job *Job) []string {
+	up := job.Upstream
+	if nil == up {
+		return nil
+	}
+	return []string{
+		"GIT_UPSTREAM_JOB_ID=" + job.UpstreamID,
+		"GIT_UPSTREAM_TIMESTAMP=" + up.Timestamp.Format(time.RFC3339),
+		"GIT_UPSTREAM_REV=" + up.Rev,
+		"GIT_UPSTREAM_REF_NAME=" + up.RefName,
+		"GIT_UPSTREAM_REF_TYPE=" + up.RefType,
+		"GIT_UPSTREAM_REPO_ID=" + up.RepoID,
+		"GIT_UPSTREAM_REPO_OWNER=" + up.Owner,
+		"GIT_UPSTREAM_REPO_NAME=" + up.Repo,
+		"GIT_UPSTREAM_HTTPS_URL=" + up.HTTPSURL,
+		"GIT_UPSTREAM_SSH_URL=" + up.SSHURL,
+	}
+}
@@ -0,0 +1,338 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// FreezesFile holds the freeze windows for every repo, ex: scripts/freezes.json
+const FreezesFile = "freezes.json"
+
+// pausesFile keeps the pauses (in the backlog dir) across a restart
+const pausesFile = "paused"
+
+// ErrNotPaused means that a repo (or the server) was resumed but wasn't paused
+var ErrNotPaused = errors.New("not paused")
+
+// FreezeWindow holds back deploys, either once (from Start until End),
+// or each time Cron comes (for Duration)
+type FreezeWindow struct {
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+	// Cron is when each freeze starts, in the server's time zone,
+	// ex: "0 17 * * fri" with a duration of "63h" for each weekend
+	Cron     string   `json:"cron,omitempty"`
+	Duration Duration `json:"duration,omitempty"`
+	// Refs limits the freeze to these branches or tags, ex: main or v*
+	// (every ref when empty)
+	Refs   []string `json:"refs,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+
+	spec *cronSpec
+}
+
+// validateFreezes checks that each window is either one-off or recurring
+func validateFreezes(windows []FreezeWindow) error {
+	for i := range windows {
+		win := &windows[i]
+		for _, pattern := range win.Refs {
+			if _, err := path.Match(pattern, ""); nil != err {
+				return fmt.Errorf("freeze %q has an invalid ref pattern %q", win.Reason, pattern)
+			}
+		}
+
+		if "" == win.Cron {
+			if win.Start.IsZero() || win.End.IsZero() {
+				return fmt.Errorf("freeze %q should have a cron and duration, or a start and end", win.Reason)
+			}
+			if !win.End.After(win.Start) {
+				return fmt.Errorf("freeze %q should end after it starts", win.Reason)
+			}
+			continue
+		}
+
+		if !win.Start.IsZero() || !win.End.IsZero() {
+			return fmt.Errorf("freeze %q should have a cron or a start and end, not both", win.Reason)
+		}
+		if win.Duration <= 0 {
+			return fmt.Errorf("freeze %q should say how long it lasts", win.Reason)
+		}
+		spec, err := parseCron(win.Cron)
+		if nil != err {
+			return err
+		}
+		win.spec = spec
+	}
+	return nil
+}
+
+// until returns when the freeze of the ref ends, or the zero time
+// if the ref isn't frozen by this window now
+func (win *FreezeWindow) until(refName string, now time.Time) time.Time {
+	if !win.matches(refName) {
+		return time.Time{}
+	}
+	if nil == win.spec {
+		if now.Before(win.Start) || !now.Before(win.End) {
+			return time.Time{}
+		}
+		return win.End
+	}
+
+	// the newest start that's still within the duration
+	d := time.Duration(win.Duration)
+	start := win.spec.next(now.Add(-d))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}
+	}
+	return start.Add(d)
+}
+
+func (win *FreezeWindow) matches(refName string) bool {
+	if 0 == len(win.Refs) {
+		return true
+	}
+	for _, pattern := range win.Refs {
+		if ok, _ := path.Match(pattern, refName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// the freezes of every repo (guarded by repoConfigsMux)
+var freezes []FreezeWindow
+
+// LoadFreezes reads the freeze windows that apply to every repo
+func LoadFreezes(runOpts *options.ServerConfig) ([]FreezeWindow, error) {
+	if 0 == len(runOpts.ScriptsPath) {
+		return nil, nil
+	}
+
+	freezesPath := filepath.Join(runOpts.ScriptsPath, FreezesFile)
+	b, err := ioutil.ReadFile(freezesPath)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	conf := struct {
+		Freezes []FreezeWindow `json:"freezes"`
+	}{}
+	if err := json.Unmarshal(b, &conf); nil != err {
+		return nil, fmt.Errorf("could not parse %s: %v", freezesPath, err)
+	}
+	if err := validateFreezes(conf.Freezes); nil != err {
+		return nil, fmt.Errorf("invalid %s: %v", freezesPath, err)
+	}
+	return conf.Freezes, nil
+}
+
+// Paused is a repo (or, with no RepoID, the whole server)
+// that won't start new jobs until it's resumed
+type Paused struct {
+	RepoID   string    `json:"repo_id,omitempty"`
+	PausedAt time.Time `json:"paused_at"`
+	PausedBy string    `json:"paused_by,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+var pausesMux sync.RWMutex
+
+// map[lowercase RepoID]*Paused, with "" for the whole server
+var pauses = make(map[string]*Paused)
+
+// the next time that a freeze ends (guarded by jobsTimersMux)
+var thawTimer *time.Timer
+var thawTime time.Time
+
+// Pause holds back new jobs of the repo (or of every repo, when repoID is empty)
+// until Resume. They wait in the queue, and jobs that are already running are left alone.
+func Pause(runOpts *options.ServerConfig, repoID, pausedBy, reason string) (*Paused, error) {
+	repoID = strings.Trim(repoID, "/")
+	if "" != repoID && len(strings.Split(repoID, "/")) < 3 {
+		return nil, ErrUnknownRepo
+	}
+	paused := &Paused{
+		RepoID:   repoID,
+		PausedAt: time.Now(),
+		PausedBy: pausedBy,
+		Reason:   reason,
+	}
+
+	pausesMux.Lock()
+	pauses[strings.ToLower(repoID)] = paused
+	err := savePauses(runOpts)
+	pausesMux.Unlock()
+
+	log.Printf("[%s] paused by %s: %s", pausedName(repoID), pausedBy, reason)
+	return paused, err
+}
+
+// Resume releases the jobs that were held back by Pause
+func Resume(runOpts *options.ServerConfig, repoID string) error {
+	repoID = strings.Trim(repoID, "/")
+
+	pausesMux.Lock()
+	if _, ok := pauses[strings.ToLower(repoID)]; !ok {
+		pausesMux.Unlock()
+		return ErrNotPaused
+	}
+	delete(pauses, strings.ToLower(repoID))
+	err := savePauses(runOpts)
+	pausesMux.Unlock()
+
+	log.Printf("[%s] resumed", pausedName(repoID))
+	checkQueue <- struct{}{}
+	return err
+}
+
+// ListPaused returns the pauses, the whole server's first
+func ListPaused() []*Paused {
+	pausesMux.RLock()
+	defer pausesMux.RUnlock()
+
+	list := []*Paused{}
+	for _, paused := range pauses {
+		copied := *paused
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].RepoID < list[j].RepoID
+	})
+	return list
+}
+
+func pausedName(repoID string) string {
+	if "" == repoID {
+		return "gitdeploy"
+	}
+	return repoID
+}
+
+// savePauses writes the pauses to the backlog dir (pausesMux must be held)
+func savePauses(runOpts *options.ServerConfig) error {
+	backlogDir, _ := filepath.Abs(runOpts.BacklogDir)
+	if err := os.MkdirAll(backlogDir, 0755); nil != err {
+		return err
+	}
+	list := []*Paused{}
+	for _, paused := range pauses {
+		list = append(list, paused)
+	}
+	b, _ := json.MarshalIndent(list, "", "  ")
+
+	f, err := ioutil.TempFile(backlogDir, "tmp-*")
+	if nil != err {
+		return err
+	}
+	_, err = f.Write(b)
+	_ = f.Close()
+	if nil != err {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(backlogDir, pausesFile))
+}
+
+// loadPauses reads the pauses that were saved before a restart
+func loadPauses(runOpts *options.ServerConfig) map[string]*Paused {
+	loaded := make(map[string]*Paused)
+	if 0 == len(runOpts.BacklogDir) {
+		return loaded
+	}
+
+	pausesPath := filepath.Join(runOpts.BacklogDir, pausesFile)
+	b, err := ioutil.ReadFile(pausesPath)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			log.Printf("[warn] could not read %s:\n%v", pausesPath, err)
+		}
+		return loaded
+	}
+	list := []*Paused{}
+	if err := json.Unmarshal(b, &list); nil != err {
+		log.Printf("[warn] could not parse %s:\n%v", pausesPath, err)
+		return loaded
+	}
+	for _, paused := range list {
+		loaded[strings.ToLower(paused.RepoID)] = paused
+	}
+	return loaded
+}
+
+// holdReason explains why the ref is held back by a pause or freeze (or is empty),
+// and when a freeze ends (or zero for a pause, which lasts until it's resumed)
+func holdReason(hook *webhooks.Ref, now time.Time) (string, time.Time) {
+	pausesMux.RLock()
+	for _, repoID := range []string{"", strings.ToLower(hook.RepoID)} {
+		if paused, ok := pauses[repoID]; ok {
+			pausesMux.RUnlock()
+			return paused.String(), time.Time{}
+		}
+	}
+	pausesMux.RUnlock()
+
+	repoConfigsMux.RLock()
+	windows := append([]FreezeWindow{}, freezes...)
+	repoConfigsMux.RUnlock()
+	windows = append(windows, getRepoConfig(hook.RepoID).Freezes...)
+	for i := range windows {
+		if until := windows[i].until(hook.RefName, now); !until.IsZero() {
+			reason := "frozen until " + until.UTC().Format(time.RFC3339)
+			if "" != windows[i].Reason {
+				reason += ": " + windows[i].Reason
+			}
+			return reason, until
+		}
+	}
+	return "", time.Time{}
+}
+
+// String is the wait reason of the jobs that are held back, ex:
+// "github.com/org/repo is paused by jane: migrating servers"
+func (paused *Paused) String() string {
+	reason := "all deploys are paused"
+	if "" != paused.RepoID {
+		reason = paused.RepoID + " is paused"
+	}
+	if "" != paused.PausedBy {
+		reason += " by " + paused.PausedBy
+	}
+	if "" != paused.Reason {
+		reason += ": " + paused.Reason
+	}
+	return reason
+}
+
+// thawAt checks the queue again once the freeze ends (jobsTimersMux must be held)
+func thawAt(until time.Time) {
+	if nil != thawTimer && !until.Before(thawTime) {
+		return
+	}
+	if nil != thawTimer {
+		thawTimer.Stop()
+	}
+	thawTime = until
+	thawTimer = time.AfterFunc(time.Until(until), func() {
+		jobsTimersMux.Lock()
+		thawTimer = nil
+		jobsTimersMux.Unlock()
+
+		checkQueue <- struct{}{}
+	})
+}
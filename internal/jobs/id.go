@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+)
+
+// crockford is the base32 alphabet of a ULID
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// jobIDLen is the length of a job ID, ex: 01ARZ3NDEKTSV4RRFFQ69G5FAV
+const jobIDLen = 26
+
+// legacyRevLen is how much of the rev was kept in RevIDs
+// and log names before they had the full rev
+const legacyRevLen = 7
+
+// minRevAbbrev is the shortest abbreviated rev that will be looked up
+const minRevAbbrev = 4
+
+var jobIDMux sync.Mutex
+var lastJobID [16]byte
+
+// NewJobID returns a unique, sortable ID (a ULID) for a run of a job.
+// IDs made in the same millisecond are still in order.
+func NewJobID() string {
+	jobIDMux.Lock()
+	defer jobIDMux.Unlock()
+
+	var id [16]byte
+	putMillis(id[:], time.Now())
+	if string(id[:6]) == string(lastJobID[:6]) {
+		// same millisecond: one more than the last one
+		id = lastJobID
+		for i := 15; i >= 6; i-- {
+			id[i]++
+			if 0 != id[i] {
+				break
+			}
+		}
+	} else if _, err := rand.Read(id[6:]); nil != err {
+		panic(err)
+	}
+	lastJobID = id
+	return encodeJobID(id)
+}
+
+// legacyJobID gives a job that was logged before jobs had IDs
+// the same ID every time its log is read
+func legacyJobID(logName string) string {
+	var id [16]byte
+	if name, ok := parseJobLogName(logName + ".json"); ok {
+		putMillis(id[:], name.Timestamp)
+	}
+	sum := sha1.Sum([]byte(logName))
+	copy(id[6:], sum[:])
+	return encodeJobID(id)
+}
+
+func putMillis(id []byte, t time.Time) {
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], ms[2:])
+}
+
+// encodeJobID writes the 128 bits as 26 base32 characters
+// (the first character only has the top 3 bits)
+func encodeJobID(id [16]byte) string {
+	var sb strings.Builder
+	for i := 0; i < jobIDLen; i++ {
+		// the bits are offset by 2, to fill 130 bits
+		var n int
+		for b := i*5 - 2; b < i*5+3; b++ {
+			n <<= 1
+			if b >= 0 && 0 != id[b/8]&(0x80>>uint(b%8)) {
+				n |= 1
+			}
+		}
+		sb.WriteByte(crockford[n])
+	}
+	return sb.String()
+}
+
+// isJobID is true for an ID made by NewJobID (rather than a RefID or RevID)
+func isJobID(id string) bool {
+	if jobIDLen != len(id) || id[0] > '7' {
+		return false
+	}
+	for i := range id {
+		if strings.IndexByte(crockford, id[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// jobLogName is a log file's name, split up
+type jobLogName struct {
+	Timestamp time.Time
+	RefName   string
+	Rev       string
+	ID        string // empty for logs from before jobs had IDs
+	Ext       string // "log" or "json"
+}
+
+// parseJobLogName reads a log file's name, which is either
+// 2020-01-01_00-00-00.master.abcdef1234567890abcdef1234567890abcdef12.01ARZ3NDEKTSV4RRFFQ69G5FAV.json
+// or, from before jobs had IDs, 2020-01-01_00-00-00.master.abc1234.json
+func parseJobLogName(name string) (*jobLogName, bool) {
+	parts := strings.Split(name, ".")
+	n := len(parts)
+	if n < 4 {
+		return nil, false
+	}
+	ts, err := time.ParseInLocation(options.TimeFile, parts[0], time.UTC)
+	if nil != err {
+		return nil, false
+	}
+	if 4 == n {
+		return &jobLogName{
+			Timestamp: ts,
+			RefName:   unescapeRefName(parts[1]),
+			Rev:       parts[2],
+			Ext:       parts[3],
+		}, true
+	}
+	if !isJobID(parts[n-2]) {
+		return nil, false
+	}
+	return &jobLogName{
+		Timestamp: ts,
+		RefName:   unescapeRefName(strings.Join(parts[1:n-3], ".")),
+		Rev:       parts[n-3],
+		ID:        parts[n-2],
+		Ext:       parts[n-1],
+	}, true
+}
+
+// escapeRefName makes a ref name safe to use as (part of) a file name,
+// ex: feature/login.v2 => feature%2Flogin%2Ev2
+// (letters, digits, and -_+@,=~ are kept as-is, which covers most branches)
+func escapeRefName(refName string) string {
+	var sb strings.Builder
+	for i := 0; i < len(refName); i++ {
+		c := refName[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			strings.IndexByte("-_+@,=~", c) >= 0 {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte("0123456789ABCDEF"[c>>4])
+		sb.WriteByte("0123456789ABCDEF"[c&15])
+	}
+	return sb.String()
+}
+
+// unescapeRefName reverses escapeRefName
+// (a name that isn't escaped, from an older version, is kept as-is)
+func unescapeRefName(escaped string) string {
+	refName, err := url.PathUnescape(escaped)
+	if nil != err {
+		return escaped
+	}
+	return refName
+}
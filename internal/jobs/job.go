@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,40 +21,93 @@ import (
 	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
 )
 
-// Pending is the map of backlog jobs
-// map[webhooks.RefID]*webhooks.GitRef
+// Pending is the map of backlog jobs (which have not yet started)
+// map[webhooks.RefID]*Job
 var Pending sync.Map
 
 // Actives is the map of jobs
 // map[webhooks.RefID]*Job
 var Actives sync.Map
 
-// Recents are jobs that are dead, but recent
+// Recents are the newest of the jobs that are dead, but recent, for each rev
 // map[webhooks.RevID]*Job
 var Recents sync.Map
 
+// RecentRuns are all of the jobs that are dead, but recent,
+// including each re-run of the same rev
+// map[string]*Job (by Job.ID)
+var RecentRuns sync.Map
+
 // Job represents a job started by the git webhook
 // and also the JSON we send back through the API about jobs
 type Job struct {
 	// normal json
 	StartedAt *time.Time    `json:"started_at,omitempty"` // empty when pending
-	ID        string        `json:"id"`                   // could be URLSafeRefID or URLSafeRevID
+	ID        string        `json:"id"`                   // unique to each run, and sortable, ex: 01ARZ3NDEKTSV4RRFFQ69G5FAV
 	GitRef    *webhooks.Ref `json:"ref"`                  // always present
 	PromoteTo string        `json:"promote_to,omitempty"` // empty when deploy and test
 	Promote   bool          `json:"promote,omitempty"`    // empty when deploy and test
 	EndedAt   *time.Time    `json:"ended_at,omitempty"`   // empty when running
 	ExitCode  *int          `json:"exit_code,omitempty"`  // empty when running
+	Status    string        `json:"status,omitempty"`     // pending, running, succeeded, failed, interrupted, superseded
+	Locks     []string      `json:"locks,omitempty"`      // shared resources held while running
+	Attempt   int           `json:"attempt,omitempty"`    // 1 for the first run, 2 for its first retry, etc
+	RetryOf   string        `json:"retry_of,omitempty"`   // the ID of the first attempt
+	// trigger json
+	Trigger     string            `json:"trigger,omitempty"`      // webhook, manual, rollback, upstream, or schedule
+	TriggeredBy string            `json:"triggered_by,omitempty"` // who asked for a manual deploy
+	Inputs      map[string]string `json:"inputs,omitempty"`       // the manual deploy's parameters, or their defaults
+	RollbackOf  string            `json:"rollback_of,omitempty"`  // the ID of the job a rollback replays
+	Upstream    *webhooks.Ref     `json:"upstream,omitempty"`     // the ref that deployed before this one
+	UpstreamID  string            `json:"upstream_id,omitempty"`  // the ID of the upstream job
+	Priority    string            `json:"priority,omitempty"`     // high, normal, or low (see PriorityRule)
+	// stages json
+	Stages []Stage `json:"stages,omitempty"` // empty unless the repo's config has stages
+	// ended json
+	SupersededBy string `json:"superseded_by,omitempty"` // the ID of the job that replaced this one
+	EndReason    string `json:"end_reason,omitempty"`    // empty unless killed: timeout, idle_timeout, killed, shutdown, superseded
+	Signal       string `json:"signal,omitempty"`        // empty unless ended by a signal, ex: SIGTERM
+	Usage        *Usage `json:"usage,omitempty"`         // empty until it ends
+	// pending json
+	QueuePosition int           `json:"queue_position,omitempty"` // only when waiting on a free worker or lock, or a pause or freeze
+	WaitReason    string        `json:"wait_reason,omitempty"`    // only when waiting on a free worker or lock, or a pause or freeze
+	DebounceUntil *time.Time    `json:"debounce_until,omitempty"` // only while waiting for pushes to settle
+	NextPush      *webhooks.Ref `json:"next_push,omitempty"`      // only for a rollback: a push that came after it, to deploy once it starts
 	// full json
 	Logs   []Log   `json:"logs,omitempty"`   // exist when requested
 	Report *Result `json:"report,omitempty"` // empty unless given
 	// internal only
-	cmd *exec.Cmd  `json:"-"`
-	mux sync.Mutex `json:"-"`
+	cmd        *exec.Cmd  `json:"-"`
+	mux        sync.Mutex `json:"-"`
+	lastOutput time.Time  `json:"-"`
+	usage      Usage      `json:"-"`
+	stage      string     `json:"-"` // the stage that's running, if any
+	finished   bool       `json:"-"` // the script, or every stage, has exited
+	logName    string     `json:"-"` // only for logs from before jobs had IDs
 }
 
 // TODO move cmd and mux here
 // type LockingJob struct { }
 
+// Job statuses
+const (
+	StatusPending     = "pending"
+	StatusRunning     = "running"
+	StatusSucceeded   = "succeeded"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted" // the server stopped while the job was running
+	StatusSuperseded  = "superseded"  // killed in favor of a newer push to the same ref
+)
+
+// Reasons for a job to have been killed
+const (
+	EndTimeout     = "timeout"      // ran longer than the max job time
+	EndIdleTimeout = "idle_timeout" // didn't write any output for the idle timeout
+	EndKilled      = "killed"       // killed through the API
+	EndShutdown    = "shutdown"     // the server stopped
+	EndSuperseded  = "superseded"   // a newer push to the same ref arrived
+)
+
 // Result may have many items and sub-items
 type Result struct {
 	Name    string      `json:"name"`
@@ -64,6 +119,7 @@ type Result struct {
 
 var initialized = false
 var done = make(chan struct{})
+var stopped = make(chan struct{})
 var deathRow = make(chan webhooks.RefID)
 var debounced = make(chan *webhooks.Ref)
 var debacklog = make(chan *webhooks.Ref)
@@ -81,58 +137,227 @@ func Run(runOpts *options.ServerConfig) {
 	}
 	initialized = true
 
-	// TODO load the backlog from disk too
+	configs, err := LoadRepoConfigs(runOpts)
+	if nil != err {
+		panic(err)
+	}
+	globalFreezes, err := LoadFreezes(runOpts)
+	if nil != err {
+		panic(err)
+	}
+	globalPriorities, err := LoadPriorities(runOpts)
+	if nil != err {
+		panic(err)
+	}
+	repoConfigsMux.Lock()
+	repoConfigs = configs
+	freezes = globalFreezes
+	priorities = globalPriorities
+	repoConfigsMux.Unlock()
+	pausesMux.Lock()
+	pauses = loadPauses(runOpts)
+	pausesMux.Unlock()
+	stopSchedules := make(chan struct{})
+	go schedule(runOpts, stopSchedules)
+
+	// anything that was queued when the server stopped gets
+	// the same debounce treatment as a freshly received webhook
+	for _, job := range loadBacklog(runOpts) {
+		log.Printf("[%s] restored from backlog", job.GitRef.GetRefID())
+		Pending.Store(job.GitRef.GetRefID(), job)
+		debounce(job.GitRef, runOpts)
+	}
+
+	// jobs that were running when the server stopped
+	for _, job := range recoverJobs(runOpts) {
+		if RequeueInterrupted != runOpts.InterruptedJobs {
+			continue
+		}
+		if _, ok := Pending.Load(job.GitRef.GetRefID()); ok {
+			// a newer push is already on its way
+			continue
+		}
+		log.Printf("[%s] re-queued after interruption", job.GitRef.GetRefID())
+		saveBacklog(&Job{GitRef: job.GitRef}, runOpts)
+		debounce(job.GitRef, runOpts)
+	}
 
 	oldJobs, err := WalkLogs(runOpts)
 	if nil != err {
 		panic(err)
 	}
 	for i := range oldJobs {
-		job := oldJobs[i]
-		job.ID = string(job.GitRef.GetRevID())
-		val, ok := Recents.Load(job.GitRef.GetRevID())
-		if !ok || val.(*Job).GitRef.Timestamp.Sub(job.GitRef.Timestamp) < 0 {
-			Recents.Store(job.GitRef.GetRevID(), job)
-		}
+		storeRecent(oldJobs[i])
 	}
+	rememberDeployedJobs(oldJobs)
 
 	ticker := time.NewTicker(runOpts.StaleJobAge / 2)
+	// once stopping, webhooks are still saved to the backlog, but no new jobs start
+	var stopping bool
+	var grace <-chan time.Time
 	for {
 		select {
 		case h := <-webhooks.Hooks:
 			hook := webhooks.New(h)
+			if reason := staleReason(hook); "" != reason {
+				log.Printf("[%s] ignored a stale webhook: %s", hook.GetRefID(), reason)
+				continue
+			}
+			job := webhookJob(hook)
+			if nil != job.NextPush {
+				log.Printf("[%s] will deploy %s after rollback %s", hook.GetRefID(), hook, job.ID)
+			}
 			//log.Printf("[%s] debouncing...", hook.GetRefID())
-			saveBacklog(hook, runOpts)
+			jobsTimersMux.Lock()
+			cancelRetry(hook.GetRefID())
+			jobsTimersMux.Unlock()
+			saveBacklog(job, runOpts)
+			if stopping {
+				continue
+			}
+			debounce(hook, runOpts)
+		case d := <-deployments:
+			hook := d.job.GitRef
+			log.Printf("[%s] %s deploy by %s", hook, d.job.Trigger, d.job.TriggeredBy)
+			jobsTimersMux.Lock()
+			cancelRetry(hook.GetRefID())
+			jobsTimersMux.Unlock()
+			saveBacklog(d.job, runOpts)
+			if stopping {
+				continue
+			}
+			if d.now {
+				run(hook, runOpts)
+				continue
+			}
 			debounce(hook, runOpts)
 		case hook := <-debacklog:
+			if stopping {
+				continue
+			}
 			//log.Printf("[%s] checking for backlog...", hook.GetRefID())
 			debounce(hook, runOpts)
 		case hook := <-debounced:
+			if stopping {
+				// stays in the backlog for the next start
+				continue
+			}
 			//log.Printf("[%s] debounced!", hook.GetRefID())
 			run(hook, runOpts)
+		case retry := <-retries:
+			if !takeRetry(retry) {
+				continue
+			}
+			// the backoff already took the place of the debounce
+			saveBacklog(retry, runOpts)
+			if stopping {
+				continue
+			}
+			run(retry.GitRef, runOpts)
 		case activeID := <-deathRow:
 			//log.Printf("[%s] done", activeID)
 			remove(runOpts, activeID /*, false*/)
+			if stopping {
+				saveRetries(runOpts)
+				if 0 == countActives() && nil != grace {
+					log.Printf("[gitdeploy] stopped")
+					grace = nil
+					close(stopped)
+				}
+				continue
+			}
+			runQueued(runOpts)
+		case <-checkQueue:
+			if stopping {
+				continue
+			}
+			runQueued(runOpts)
 		case promotion := <-Promotions:
+			if stopping {
+				log.Printf("[%s] not promoting to %s while stopping", promotion.GitRef.GetRefID(), promotion.PromoteTo)
+				continue
+			}
 			log.Printf("[%s] promoting to %s", promotion.GitRef.GetRefID(), promotion.PromoteTo)
-			promote(webhooks.New(*promotion.GitRef), promotion.PromoteTo, runOpts)
+			promotion.GitRef = webhooks.New(*promotion.GitRef)
+			queuePromotion(promotion, runOpts)
 		case <-ticker.C:
 			log.Printf("[gitdeploy] cleaning old jobs")
 			expire(runOpts)
 		case <-done:
-			log.Printf("[gitdeploy] stopping")
-			// TODO kill jobs
-			ticker.Stop()
+			if stopping {
+				continue
+			}
+			stopping = true
+			close(stopSchedules)
+			saveRetries(runOpts)
+			n := countActives()
+			if 0 == n {
+				log.Printf("[gitdeploy] stopped")
+				close(stopped)
+				continue
+			}
+			log.Printf("[gitdeploy] stopping: waiting up to %s for %d job(s) to finish", runOpts.ShutdownTimeout, n)
+			grace = time.After(runOpts.ShutdownTimeout)
+		case <-grace:
+			log.Printf("[gitdeploy] stopping: killing %d job(s) that didn't finish in time", countActives())
+			interruptAll(runOpts)
 		}
 	}
 }
 
-// Stop will cancel the job loop and its timers
+// Stop stops starting new jobs, gives the active jobs up to
+// ShutdownTimeout to finish, and then kills whatever is left.
+// It returns once every job's final record has been written.
 func Stop() {
 	done <- struct{}{}
+	<-stopped
 	initialized = false
 }
 
+// isActive is true when the job is still stored by any ID
+// (a promotion is stored under several)
+func isActive(job *Job) bool {
+	var found bool
+	Actives.Range(func(key, value interface{}) bool {
+		found = job == value.(*Job)
+		return !found
+	})
+	return found
+}
+
+func countActives() int {
+	var n int
+	Actives.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// interruptAll kills every active job because the server is stopping
+func interruptAll(runOpts *options.ServerConfig) {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	Actives.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		job.mux.Lock()
+		if "" == job.Status {
+			job.Status = StatusInterrupted
+		}
+		job.mux.Unlock()
+
+		if !job.Promote && RequeueInterrupted == runOpts.InterruptedJobs {
+			if _, ok := Pending.Load(job.GitRef.GetRefID()); !ok {
+				saveBacklog(&Job{GitRef: job.GitRef}, runOpts)
+			}
+		}
+
+		terminate(job, EndShutdown, runOpts)
+		return true
+	})
+}
+
 // All returns all jobs, including active, recent, and (TODO) historical
 func All(then time.Time) []*Job {
 	jobsTimersMux.Lock()
@@ -141,34 +366,49 @@ func All(then time.Time) []*Job {
 	jobsCopy := []*Job{}
 
 	Pending.Range(func(key, value interface{}) bool {
-		hook := value.(*webhooks.Ref)
+		job := value.(*Job)
+		hook := job.GitRef
 		if hook.Timestamp.Sub(then) <= 0 {
 			return true
 		}
 
-		jobCopy := &Job{
-			//StartedAt: job.StartedAt,
-			ID:     string(hook.GetURLSafeRefID()),
-			GitRef: hook,
-			//Promote:   job.Promote,
-			//EndedAt:   job.EndedAt,
-		}
-		jobsCopy = append(jobsCopy, jobCopy)
+		jobsCopy = append(jobsCopy, pendingCopy(job))
 		return true
 	})
 
+	for _, scheduled := range scheduledRetries {
+		jobsCopy = append(jobsCopy, retryCopy(scheduled))
+	}
+
+	// a promotion is stored under several IDs, but is only one job
+	seen := map[*Job]bool{}
 	Actives.Range(func(key, value interface{}) bool {
 		job := value.(*Job)
-		if job.GitRef.Timestamp.Sub(then) <= 0 {
+		if job.GitRef.Timestamp.Sub(then) <= 0 || seen[job] {
 			return true
 		}
+		seen[job] = true
 
 		jobCopy := &Job{
 			StartedAt: job.StartedAt,
-			ID:        string(job.GitRef.GetURLSafeRefID()),
+			ID:        job.ID,
 			GitRef:    job.GitRef,
+			Status:    StatusRunning,
+			Locks:     job.Locks,
+			Attempt:   job.Attempt,
+			RetryOf:   job.RetryOf,
 			//Promote:   job.Promote,
 		}
+		jobCopy.Trigger = job.Trigger
+		jobCopy.TriggeredBy = job.TriggeredBy
+		jobCopy.Inputs = job.Inputs
+		jobCopy.RollbackOf = job.RollbackOf
+		jobCopy.Upstream = job.Upstream
+		jobCopy.UpstreamID = job.UpstreamID
+		jobCopy.Priority = job.Priority
+		job.mux.Lock()
+		jobCopy.Stages = copyStages(job.Stages)
+		job.mux.Unlock()
 		if nil != job.ExitCode {
 			copied := *job.ExitCode
 			jobCopy.ExitCode = &copied
@@ -177,7 +417,7 @@ func All(then time.Time) []*Job {
 		return true
 	})
 
-	Recents.Range(func(key, value interface{}) bool {
+	RecentRuns.Range(func(key, value interface{}) bool {
 		job := value.(*Job)
 		if job.GitRef.Timestamp.Sub(then) <= 0 {
 			return true
@@ -185,11 +425,26 @@ func All(then time.Time) []*Job {
 
 		jobCopy := &Job{
 			StartedAt: job.StartedAt,
-			ID:        string(job.GitRef.GetURLSafeRevID()),
+			ID:        job.ID,
 			GitRef:    job.GitRef,
 			EndedAt:   job.EndedAt,
+			Status:    job.Status,
+			Attempt:   job.Attempt,
+			RetryOf:   job.RetryOf,
 			//Promote:   job.Promote,
 		}
+		jobCopy.Trigger = job.Trigger
+		jobCopy.TriggeredBy = job.TriggeredBy
+		jobCopy.Inputs = job.Inputs
+		jobCopy.RollbackOf = job.RollbackOf
+		jobCopy.Upstream = job.Upstream
+		jobCopy.UpstreamID = job.UpstreamID
+		jobCopy.Priority = job.Priority
+		jobCopy.Stages = job.Stages
+		jobCopy.SupersededBy = job.SupersededBy
+		jobCopy.EndReason = job.EndReason
+		jobCopy.Signal = job.Signal
+		jobCopy.Usage = job.Usage
 		if nil != job.ExitCode {
 			copied := *job.ExitCode
 			jobCopy.ExitCode = &copied
@@ -202,50 +457,145 @@ func All(then time.Time) []*Job {
 }
 
 // SetReport will update jobs' logs
-func SetReport(urlRefID webhooks.URLSafeRefID, result *Result) error {
-	b, err := base64.RawURLEncoding.DecodeString(string(urlRefID))
-	if nil != err {
-		return err
-	}
-	refID := webhooks.RefID(b)
-
-	value, ok := Actives.Load(refID)
+func SetReport(id string, result *Result) error {
+	job, ok := findActive(id)
 	if !ok {
-		return errors.New("active job not found by " + string(refID))
+		return errors.New("active job not found by " + id)
 	}
-	job := value.(*Job)
 
-	// needs mutex (prevent double update)
+	job.mux.Lock()
 	job.Report = result
-	Actives.Store(refID, job)
+	job.mux.Unlock()
 
 	return nil
 }
 
-// Remove will put a job on death row
-func Remove(gitID webhooks.URLSafeRefID /*, nokill bool*/) {
-	activeID, err :=
-		base64.RawURLEncoding.DecodeString(string(gitID))
-	if nil != err {
-		log.Printf("bad id: %s", activeID)
-		return
+// FindRefID returns the RefID of the active or pending job with the given ID
+// (or URL-safe RefID, as was used before jobs had IDs)
+func FindRefID(id string) (webhooks.RefID, bool) {
+	if job, ok := findActive(id); ok {
+		return job.GitRef.GetRefID(), true
+	}
+	var refID webhooks.RefID
+	Pending.Range(func(key, value interface{}) bool {
+		if id == value.(*Job).ID {
+			refID = key.(webhooks.RefID)
+			return false
+		}
+		return true
+	})
+	if "" != refID {
+		return refID, true
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(id); nil == err {
+		if _, ok := Pending.Load(webhooks.RefID(b)); ok {
+			return webhooks.RefID(b), true
+		}
+	}
+	return "", false
+}
+
+// findActive finds a running job by its ID (or URL-safe RefID)
+func findActive(id string) (*Job, bool) {
+	var found *Job
+	Actives.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		if id == job.ID {
+			found = job
+			return false
+		}
+		return true
+	})
+	if nil != found {
+		return found, true
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(id); nil == err {
+		if value, ok := Actives.Load(webhooks.RefID(b)); ok {
+			return value.(*Job), true
+		}
+	}
+	return nil, false
+}
+
+// storeRecent keeps a dead job by its ID and, if it's the newest of its rev, by its RevID
+func storeRecent(job *Job) {
+	RecentRuns.Store(job.ID, job)
+	revID := job.GitRef.GetRevID()
+	val, ok := Recents.Load(revID)
+	if !ok || !val.(*Job).GitRef.Timestamp.After(job.GitRef.Timestamp) {
+		Recents.Store(revID, job)
+	}
+}
+
+// hasRevID is true when the job's rev is, or starts with, the RevID's rev
+// (so that an abbreviated RevID still finds its job)
+func hasRevID(hook *webhooks.Ref, revID webhooks.RevID) bool {
+	i := strings.LastIndex(string(revID), "#")
+	if i < 0 {
+		return false
 	}
-	deathRow <- webhooks.RefID(activeID)
+	repoID, rev := string(revID)[:i], string(revID)[i+1:]
+	if len(rev) < minRevAbbrev || !strings.EqualFold(repoID, hook.RepoID) {
+		return false
+	}
+	return strings.HasPrefix(hook.Rev, strings.ToLower(rev))
+}
+
+// findRecent finds the newest recent job for a RevID, which may be abbreviated
+func findRecent(revID webhooks.RevID) (*Job, bool) {
+	if value, ok := Recents.Load(revID); ok {
+		return value.(*Job), true
+	}
+	var newest *Job
+	Recents.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		if !hasRevID(job.GitRef, revID) {
+			return true
+		}
+		if nil == newest || job.GitRef.Timestamp.After(newest.GitRef.Timestamp) {
+			newest = job
+		}
+		return true
+	})
+	return newest, nil != newest
 }
 
-func getJobFilePath(baseDir string, hook *webhooks.Ref, suffix string) (string, string, error) {
+// Remove will put a job on death row
+func Remove(activeID webhooks.RefID /*, nokill bool*/) {
+	deathRow <- activeID
+}
+
+func getJobFilePath(baseDir string, job *Job, suffix string) (string, string, error) {
 	baseDir, _ = filepath.Abs(baseDir)
-	fileTime := hook.Timestamp.UTC().Format(options.TimeFile)
-	fileName := fileTime + "." + hook.RefName + "." + hook.Rev[:7] + suffix // ".log" or ".json"
-	fileDir := filepath.Join(baseDir, hook.RepoID)
+	fileName := getJobLogName(job) + suffix // ".log" or ".json"
+	fileDir := filepath.Join(baseDir, job.GitRef.RepoID)
 
 	err := os.MkdirAll(fileDir, 0755)
 
 	return fileDir, fileName, err
 }
 
-func getJobFile(baseDir string, hook *webhooks.Ref, suffix string) (*os.File, error) {
-	repoDir, repoFile, err := getJobFilePath(baseDir, hook, suffix)
+// getJobLogName is the name of the job's log, without the ".log" or ".json", ex:
+// 2020-01-01_00-00-00.master.abcdef1234567890abcdef1234567890abcdef12.01ARZ3NDEKTSV4RRFFQ69G5FAV
+func getJobLogName(job *Job) string {
+	if "" != job.logName {
+		return job.logName
+	}
+	hook := job.GitRef
+	fileTime := hook.Timestamp.UTC().Format(options.TimeFile)
+	if !isJobID(job.ID) {
+		// from before jobs had IDs, ex: 2020-01-01_00-00-00.master.abc1234
+		rev := hook.Rev
+		if len(rev) > legacyRevLen {
+			rev = rev[:legacyRevLen]
+		}
+		return fileTime + "." + escapeRefName(hook.RefName) + "." + rev
+	}
+	return fileTime + "." + escapeRefName(hook.RefName) + "." + hook.Rev + "." + job.ID
+}
+
+func getJobFile(baseDir string, job *Job, suffix string) (*os.File, error) {
+	repoDir, repoFile, err := getJobFilePath(baseDir, job, suffix)
 	if nil != err {
 		//log.Printf("[warn] could not create log directory '%s': %v", repoDir, err)
 		return nil, err
@@ -256,8 +606,8 @@ func getJobFile(baseDir string, hook *webhooks.Ref, suffix string) (*os.File, er
 	//return fmt.Sprintf("%s#%s", strings.ReplaceAll(hook.RepoID, "/", "-"), hook.RefName)
 }
 
-func openJobFile(baseDir string, hook *webhooks.Ref, suffix string) (*os.File, error) {
-	repoDir, repoFile, _ := getJobFilePath(baseDir, hook, suffix)
+func openJobFile(baseDir string, job *Job, suffix string) (*os.File, error) {
+	repoDir, repoFile, _ := getJobFilePath(baseDir, job, suffix)
 	return os.Open(filepath.Join(repoDir, repoFile))
 }
 
@@ -284,7 +634,7 @@ func setOutput(logDir string, job *Job) *os.File {
 	}
 
 	hook := job.GitRef
-	f, err := getJobFile(logDir, hook, ".log")
+	f, err := getJobFile(logDir, job, ".log")
 	if nil != err {
 		// f.Name() should be the full path
 		log.Printf("[warn] could not create log file '%s': %v", logDir, err)
@@ -301,40 +651,143 @@ func Debounce(hook webhooks.Ref) {
 	webhooks.Hooks <- hook
 }
 
+// outputWaitDelay is how long to keep reading a job's output once its script has exited
+const outputWaitDelay = 2 * time.Second
+
 var jobsTimersMux sync.Mutex
 var debounceTimers = make(map[webhooks.RefID]*time.Timer)
 
+// when each debounce timer goes off (guarded by jobsTimersMux)
+var debounceDeadlines = make(map[webhooks.RefID]time.Time)
+
+// when the first push of each burst came, for max_wait (guarded by jobsTimersMux)
+var debounceStarts = make(map[webhooks.RefID]time.Time)
+
+// when the last push came, for leading (guarded by jobsTimersMux)
+var lastPushes = make(map[webhooks.RefID]time.Time)
+
 func debounce(hook *webhooks.Ref, runOpts *options.ServerConfig) {
 	jobsTimersMux.Lock()
 	defer jobsTimersMux.Unlock()
 
 	activeID := hook.GetRefID()
-	if _, ok := Actives.Load(activeID); ok {
+	if value, ok := Actives.Load(activeID); ok {
+		job := value.(*Job)
+		if !job.Promote && getRepoConfig(hook.RepoID).Supersede {
+			// the newer rev runs as soon as this one is gone
+			supersede(job, hook, runOpts)
+			return
+		}
 		//log.Printf("[%s] will run again after current job", hook.GetRefID())
 		return
 	}
 
 	refID := hook.GetRefID()
+	now := time.Now()
+	delay := debounceWait(hook, runOpts, now)
 	timer, ok := debounceTimers[refID]
 	if ok {
 		//log.Printf("[%s] replaced debounce timer", hook.GetRefID())
 		timer.Stop()
 	}
 	// this will not cause a mutual lock because it is async
-	debounceTimers[refID] = time.AfterFunc(runOpts.DebounceDelay, func() {
+	debounceDeadlines[refID] = now.Add(delay)
+	debounceTimers[refID] = time.AfterFunc(delay, func() {
 		jobsTimersMux.Lock()
-		delete(debounceTimers, refID)
+		stopDebounce(refID)
 		jobsTimersMux.Unlock()
 
 		debounced <- hook
 	})
 }
 
-func saveBacklog(hook *webhooks.Ref, runOpts *options.ServerConfig) {
+// debounceWait is how long to wait for more pushes to the ref, per the repo's
+// debounce config: the delay, cut short by max_wait or by leading (for the first
+// push after a quiet spell), but never sooner than min_interval allows
+// (jobsTimersMux must be held)
+func debounceWait(hook *webhooks.Ref, runOpts *options.ServerConfig, now time.Time) time.Duration {
+	refID := hook.GetRefID()
+	conf := getRepoConfig(hook.RepoID).Debounce
+	if nil == conf {
+		conf = &DebounceConfig{}
+	}
+	delay := runOpts.DebounceDelay
+	if conf.Delay > 0 {
+		delay = time.Duration(conf.Delay)
+	}
+
+	_, waiting := debounceTimers[refID]
+	first, ok := debounceStarts[refID]
+	if !waiting || !ok {
+		first = now
+		debounceStarts[refID] = now
+	}
+
+	if conf.Leading {
+		last, ok := lastPushes[refID]
+		lastPushes[refID] = now
+		if !waiting && (!ok || now.Sub(last) >= delay) {
+			delay = 0
+		}
+	}
+
+	if conf.MaxWait > 0 {
+		deadline := first.Add(time.Duration(conf.MaxWait))
+		if now.Add(delay).After(deadline) {
+			delay = deadline.Sub(now)
+			if delay < 0 {
+				delay = 0
+			}
+		}
+	}
+
+	if conf.MinInterval > 0 {
+		if last := lastSucceeded(refID); !last.IsZero() {
+			next := last.Add(time.Duration(conf.MinInterval))
+			if now.Add(delay).Before(next) {
+				log.Printf("[%s] throttled until %s", refID, next.UTC().Format(time.RFC3339))
+				delay = next.Sub(now)
+			}
+		}
+	}
+	return delay
+}
+
+// stopDebounce stops the ref's debounce timer, if any (jobsTimersMux must be held)
+func stopDebounce(refID webhooks.RefID) {
+	if timer, ok := debounceTimers[refID]; ok {
+		timer.Stop()
+	}
+	delete(debounceTimers, refID)
+	delete(debounceDeadlines, refID)
+	delete(debounceStarts, refID)
+}
+
+// lastSucceeded is when the ref's newest successful deploy ended, or zero
+func lastSucceeded(refID webhooks.RefID) time.Time {
+	var last time.Time
+	RecentRuns.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		if job.Promote || StatusSucceeded != job.Status || nil == job.EndedAt {
+			return true
+		}
+		if refID == job.GitRef.GetRefID() && job.EndedAt.After(last) {
+			last = *job.EndedAt
+		}
+		return true
+	})
+	return last
+}
+
+func saveBacklog(job *Job, runOpts *options.ServerConfig) {
+	if "" == job.ID {
+		job.ID = NewJobID()
+	}
+	hook := job.GitRef
 	pendingID := hook.GetRefID()
-	Pending.Store(pendingID, hook)
+	Pending.Store(pendingID, job)
 
-	repoDir, repoFile, err := getBacklogFilePath(runOpts.TmpDir, hook)
+	repoDir, repoFile, err := getBacklogFilePath(runOpts.BacklogDir, hook)
 	if nil != err {
 		log.Printf("[warn] could not create backlog dir %s:\n%v", repoDir, err)
 		return
@@ -345,7 +798,7 @@ func saveBacklog(hook *webhooks.Ref, runOpts *options.ServerConfig) {
 		return
 	}
 
-	b, _ := json.MarshalIndent(hook, "", "  ")
+	b, _ := json.MarshalIndent(job, "", "  ")
 	if _, err := f.Write(b); nil != err {
 		log.Printf("[warn] could not write backlog file %s:\n%v", f.Name(), err)
 		return
@@ -371,7 +824,7 @@ func saveBacklog(hook *webhooks.Ref, runOpts *options.ServerConfig) {
 
 func getBacklogFilePath(baseDir string, hook *webhooks.Ref) (string, string, error) {
 	baseDir, _ = filepath.Abs(baseDir)
-	fileName := hook.RefName + ".json"
+	fileName := escapeRefName(hook.RefName) + ".json"
 	fileDir := filepath.Join(baseDir, hook.RepoID)
 
 	err := os.MkdirAll(fileDir, 0755)
@@ -379,6 +832,96 @@ func getBacklogFilePath(baseDir string, hook *webhooks.Ref) (string, string, err
 	return fileDir, fileName, err
 }
 
+// loadBacklog reads the pending jobs that were saved before a restart
+func loadBacklog(runOpts *options.ServerConfig) []*Job {
+	pendings := []*Job{}
+	if 0 == len(runOpts.BacklogDir) {
+		return pendings
+	}
+
+	backlogDir, _ := filepath.Abs(runOpts.BacklogDir)
+	err := filepath.WalkDir(backlogDir, func(backlogPath string, d fs.DirEntry, err error) error {
+		if nil != err {
+			if !os.IsNotExist(err) {
+				log.Printf("[warn] failed to walk backlog dir: %v", err)
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := d.Name()
+		if strings.HasPrefix(name, "tmp-") && !strings.Contains(name, ".") {
+			// a write that never finished (not a branch named tmp-*)
+			_ = os.Remove(backlogPath)
+			return nil
+		}
+		if strings.HasSuffix(name, ".json.cur") {
+			// the server stopped just as this was being picked up
+			jsonPath := strings.TrimSuffix(backlogPath, ".cur")
+			if _, err := os.Stat(jsonPath); nil == err {
+				// a newer push has already replaced it
+				_ = os.Remove(backlogPath)
+				return nil
+			}
+			if err := os.Rename(backlogPath, jsonPath); nil != err {
+				log.Printf("[warn] could not restore backlog file %s:\n%v", backlogPath, err)
+				return nil
+			}
+			backlogPath = jsonPath
+		} else if !strings.HasSuffix(name, ".json") {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(backlogPath)
+		if nil != err {
+			log.Printf("[warn] could not read backlog file %s:\n%v", backlogPath, err)
+			return nil
+		}
+		job, err := parseBacklog(b)
+		if nil != err {
+			log.Printf("[warn] could not parse backlog %s:\n%v", backlogPath, err)
+			return nil
+		}
+		pendings = append(pendings, job)
+		return nil
+	})
+	if nil != err {
+		log.Printf("[warn] could not load backlog: %v", err)
+	}
+
+	return pendings
+}
+
+// parseBacklog reads a pending job (or, from older versions, a bare webhooks.Ref)
+func parseBacklog(b []byte) (*Job, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); nil != err {
+		return nil, err
+	}
+
+	job := &Job{}
+	if _, legacy := fields["repo_id"]; legacy {
+		job.GitRef = &webhooks.Ref{}
+		if err := json.Unmarshal(b, job.GitRef); nil != err {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(b, job); nil != err {
+		return nil, err
+	}
+	if nil == job.GitRef {
+		return nil, errors.New("backlog has no ref")
+	}
+	if !isJobID(job.ID) {
+		// from before jobs had IDs
+		job.ID = NewJobID()
+	}
+	// keeps the original timestamp
+	job.GitRef = webhooks.New(*job.GitRef)
+	return job, nil
+}
+
 func run(curHook *webhooks.Ref, runOpts *options.ServerConfig) {
 	// because we want to lock the whole transaction all of the state
 	jobsTimersMux.Lock()
@@ -390,12 +933,12 @@ func run(curHook *webhooks.Ref, runOpts *options.ServerConfig) {
 		return
 	}
 
-	var hook *webhooks.Ref
+	var pending *Job
 	// Legacy, but would be nice to repurpose for resuming on reload
-	repoDir, repoFile, _ := getBacklogFilePath(runOpts.TmpDir, curHook)
+	repoDir, repoFile, _ := getBacklogFilePath(runOpts.BacklogDir, curHook)
 	backlogFile := filepath.Join(repoDir, repoFile)
 	if value, ok := Pending.Load(pendingID); ok {
-		hook = value.(*webhooks.Ref)
+		pending = value.(*Job)
 	} else {
 		// TODO add mutex (should not affect temp files)
 		_ = os.Remove(backlogFile + ".cur")
@@ -411,73 +954,230 @@ func run(curHook *webhooks.Ref, runOpts *options.ServerConfig) {
 			return
 		}
 
-		hook = &webhooks.Ref{}
-		if err := json.Unmarshal(b, hook); nil != err {
+		pending, err = parseBacklog(b)
+		if nil != err {
 			log.Printf("[warn] could not parse backlog %s:\n%v", backlogFile, err)
 			return
 		}
-		hook = webhooks.New(*hook)
 	}
 
+	if reason := waitReason(pending.GitRef, runOpts); "" != reason {
+		// stays in the backlog until a worker is free
+		Pending.Store(pendingID, pending)
+		_ = os.Rename(backlogFile+".cur", backlogFile)
+		enqueue(pendingID, reason)
+		return
+	}
+
+	start(pending, runOpts)
+}
+
+// start runs the pending job right away (jobsTimersMux must be held)
+func start(j *Job, runOpts *options.ServerConfig) {
+	hook := j.GitRef
+	pendingID := hook.GetRefID()
+	repoDir, repoFile, _ := getBacklogFilePath(runOpts.BacklogDir, hook)
+	backlogFile := filepath.Join(repoDir, repoFile)
+
+	dequeue(pendingID)
 	Pending.Delete(pendingID)
 	_ = os.Remove(backlogFile)
 	_ = os.Remove(backlogFile + ".cur")
+	if nil != j.NextPush {
+		// the push that came after the rollback runs once the rollback is done
+		saveBacklog(&Job{GitRef: j.NextPush, Trigger: TriggerWebhook}, runOpts)
+		j.NextPush = nil
+	}
+	j.Priority = priorityClass(j)
 
+	if "" == j.ID {
+		j.ID = NewJobID()
+	}
 	env := os.Environ()
-	envs := getEnvs(runOpts.Addr, string(pendingID), runOpts.RepoList, hook)
-	envs = append(envs, "GIT_DEPLOY_JOB_ID="+string(pendingID))
+	envs := getEnvs(runOpts.Addr, j.ID, j.ID, runOpts.RepoList, hook)
+	if 0 == j.Attempt {
+		j.Attempt = 1
+	}
+	envs = append(envs, "GIT_DEPLOY_ATTEMPT="+strconv.Itoa(j.Attempt))
+	if "" != j.Trigger {
+		envs = append(envs, "GIT_DEPLOY_TRIGGER="+j.Trigger)
+	}
+	if "" != j.RollbackOf {
+		envs = append(envs, "GIT_DEPLOY_ROLLBACK_OF="+j.RollbackOf)
+	}
+	if nil == j.Inputs {
+		j.Inputs = getRepoConfig(hook.RepoID).defaultInputs()
+	}
+	for name, val := range j.Inputs {
+		envs = append(envs, InputEnv(name)+"="+val)
+	}
+	envs = append(envs, upstreamEnvs(j)...)
+
+	conf := getRepoConfig(hook.RepoID)
+	// with --pipelines, a trusted repo without its own scripts is checked out
+	// by gitdeploy, which then runs its pipeline file (or deploy.sh, as before)
+	checkout := runOpts.Pipelines && isTrusted(runOpts.RepoList, hook.RepoID) &&
+		!hasScripts(runOpts.ScriptsPath, hook.RepoID)
+	if checkout {
+		j.Stages = []Stage{{Name: StageCheckout, Status: StatusPending}}
+	} else {
+		j.Stages = newStages(conf.Stages)
+	}
+	var workspace string
+	if len(j.Stages) > 0 {
+		// so that later stages can use what earlier stages built
+		var err error
+		workspace, err = ioutil.TempDir("", "gitdeploy-workspace-*")
+		if nil != err {
+			log.Printf("[warn] could not create workspace: %v", err)
+		}
+		envs = append(envs, "GIT_DEPLOY_WORKSPACE="+workspace)
+	}
 
 	scriptPath, _ := filepath.Abs(runOpts.ScriptsPath + "/deploy.sh")
-	args := []string{"-i", "--", scriptPath}
-
-	log.Printf("[%s] bash %s %s %s", hook.GetRefID(), args[0], args[1], args[2])
-	cmd := exec.Command("bash", append(args, []string{
-		string(pendingID),
-		hook.RefName,
-		hook.RefType,
-		hook.Owner,
-		hook.Repo,
-		hook.HTTPSURL,
-	}...)...)
-	cmd.Env = append(env, envs...)
+	// not interactive (-i), which would put each child in a process group of its own,
+	// out of reach of terminate, and would ignore SIGTERM itself
+	args := []string{"--", scriptPath}
+
+	log.Printf("[%s] bash %s %s", hook.GetRefID(), args[0], args[1])
+	// newCmd is the command for the job (i < 0), or for one of its stages
+	// (j.mux must be held)
+	newCmd := func(i int) *exec.Cmd {
+		var cmd *exec.Cmd
+		var stageEnvs []string
+		switch {
+		case i < 0:
+			// the whole job is just deploy.sh
+		case checkout && 0 == i:
+			cmd = exec.Command("bash", "-c", checkoutScript)
+		case nil != j.Stages[i].step:
+			cmd = stepCmd(j.Stages[i].step, getCheckoutDir(workspace, hook))
+			stageEnvs = j.Stages[i].step.env()
+		}
+		if nil == cmd {
+			cmd = exec.Command("bash", append(args, []string{
+				j.ID,
+				hook.RefName,
+				hook.RefType,
+				hook.Owner,
+				hook.Repo,
+				hook.HTTPSURL,
+			}...)...)
+		}
+		cmd.Env = append(append([]string{}, env...), envs...)
+		cmd.Env = append(cmd.Env, stageEnvs...)
+		if i >= 0 {
+			cmd.Env = append(cmd.Env, stageEnv(j.Stages[i].Name))
+		}
+		setProcessGroup(cmd)
+		// a child that outlives the script (ex: a daemon) may still hold
+		// its stdout, which would otherwise keep cmd.Wait from returning
+		cmd.WaitDelay = outputWaitDelay
+		return cmd
+	}
+	var cmd *exec.Cmd
+	if len(j.Stages) > 0 {
+		cmd = newCmd(0)
+	} else {
+		cmd = newCmd(-1)
+	}
 
 	now := time.Now()
-	j := &Job{
-		StartedAt: &now,
-		cmd:       cmd,
-		GitRef:    hook,
-		Logs:      []Log{},
-		Promote:   false,
-	}
+	j.StartedAt = &now
+	j.cmd = cmd
+	j.Locks = conf.Locks
+	j.Logs = []Log{}
+	j.lastOutput = now
 	// TODO jobs.New()
 	// Sets cmd.Stdout and cmd.Stderr
 	txtFile := setOutput(runOpts.LogDir, j)
 
-	if err := cmd.Start(); nil != err {
-		log.Printf("[ERROR] failed to exec: %s\n", err)
+	var err error
+	if len(j.Stages) > 0 {
+		j.mux.Lock()
+		err = startStage(j, 0, cmd)
+		j.mux.Unlock()
+	} else {
+		err = cmd.Start()
+	}
+	if nil != err {
+		log.Printf("[ERROR] [%s] failed to exec: %s\n", pendingID, err)
+		failStart(j, cmd, err, workspace, txtFile)
 		return
 	}
 
 	Actives.Store(pendingID, j)
+	saveJournal(j, runOpts)
+
+	maxJobTime := runOpts.DefaultMaxJobTime
+	if conf.MaxJobTime > 0 {
+		maxJobTime = time.Duration(conf.MaxJobTime)
+	}
+	idleTimeout := runOpts.IdleTimeout
+	if conf.IdleTimeout > 0 {
+		idleTimeout = time.Duration(conf.IdleTimeout)
+	}
 
 	go func() {
-		timer := time.AfterFunc(runOpts.DefaultMaxJobTime, func() {
+		timer := time.AfterFunc(maxJobTime, func() {
 			if nil == cmd.Process {
 				log.Printf("[SANITY] [%s] never exited, but does not exist", pendingID)
 			}
-			if err := cmd.Process.Kill(); nil != err {
-				log.Printf("[%s] failed to kill process: %v", pendingID, err)
-			}
+			log.Printf("[%s] timed out after %s", pendingID, maxJobTime)
+			terminate(j, EndTimeout, runOpts)
 			//deathRow <- pendingID
 		})
+		exited := make(chan struct{})
+		if idleTimeout > 0 {
+			go watchIdle(j, idleTimeout, exited, runOpts)
+		}
 
 		//log.Printf("[%s] job started", pendingID)
-		if err := cmd.Wait(); nil != err {
+		if len(j.Stages) > 0 {
+			runner := &stageRunner{
+				job:    j,
+				newCmd: newCmd,
+				started: func() {
+					saveJournal(j, runOpts)
+				},
+				killGracePeriod: runOpts.KillGracePeriod,
+			}
+			runner.succeeded = func(i int) error {
+				j.mux.Lock()
+				stage := j.Stages[i]
+				j.mux.Unlock()
+				checkoutDir := getCheckoutDir(workspace, hook)
+				if checkout && 0 == i {
+					return addPipelineStages(j, conf, checkoutDir)
+				}
+				if nil == stage.step || 0 == len(stage.step.Artifacts) {
+					return nil
+				}
+				saved, err := saveArtifacts(stage.step, checkoutDir, getArtifactsDir(runOpts.LogDir, j))
+				j.mux.Lock()
+				j.Stages[i].Artifacts = saved
+				j.mux.Unlock()
+				return err
+			}
+			runner.run()
+			if failed := failedStage(j); nil != failed {
+				log.Printf("[%s] failed at stage %s", pendingID, failed.Name)
+			} else {
+				log.Printf("[%s] exited successfully", pendingID)
+			}
+			if "" != workspace {
+				_ = os.RemoveAll(workspace)
+			}
+		} else if err := cmd.Wait(); nil != err {
 			log.Printf("[%s] exited with error: %v", pendingID, err)
 		} else {
 			log.Printf("[%s] exited successfully", pendingID)
 		}
+		j.mux.Lock()
+		j.finished = true
+		j.mux.Unlock()
 		_ = timer.Stop()
+		close(exited)
 
 		if nil != txtFile {
 			_ = txtFile.Close()
@@ -486,33 +1186,147 @@ func run(curHook *webhooks.Ref, runOpts *options.ServerConfig) {
 		// this will completely clear the finished job
 		deathRow <- pendingID
 
+		j.mux.Lock()
+		superseded := StatusSuperseded == j.Status
+		j.mux.Unlock()
+		if superseded {
+			// skips the debounce
+			debounced <- hook
+			return
+		}
+
 		// debounces without saving in the backlog
 		// TODO move this into deathRow?
 		debacklog <- hook
 	}()
 }
 
-func getEnvs(addr, activeID string, repoList string, hook *webhooks.Ref) []string {
+// failStart ends a job whose script (or first stage) could not be started:
+// it's out of the backlog already, so it's recorded as failed by remove,
+// with a log and a retry, as any other job that ended (jobsTimersMux must be held)
+func failStart(j *Job, cmd *exec.Cmd, err error, workspace string, txtFile *os.File) {
+	hook := j.GitRef
+	if nil != cmd.Stderr {
+		_, _ = cmd.Stderr.Write([]byte("failed to exec: " + err.Error() + "\n"))
+	}
+	j.mux.Lock()
+	if len(j.Stages) > 0 {
+		j.Stages[0].Error = err.Error()
+	}
+	j.finished = true
+	j.mux.Unlock()
+	if "" != workspace {
+		_ = os.RemoveAll(workspace)
+	}
+	if nil != txtFile {
+		_ = txtFile.Close()
+	}
+
+	Actives.Store(hook.GetRefID(), j)
+	// not from the job loop, which may be the caller
+	go func() {
+		deathRow <- hook.GetRefID()
+		debacklog <- hook
+	}()
+}
 
-	port := strings.Split(addr, ":")[1]
+// watchIdle kills the job if it stops writing output for idleTimeout
+func watchIdle(job *Job, idleTimeout time.Duration, exited <-chan struct{}, runOpts *options.ServerConfig) {
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
 
-	envs := []string{
-		"GIT_DEPLOY_JOB_ID=" + activeID,
-		"GIT_DEPLOY_TIMESTAMP=" + hook.Timestamp.Format(time.RFC3339),
-		"GIT_DEPLOY_CALLBACK_URL=" + "http://localhost:" + port + "/api/local/jobs/" + string(hook.GetURLSafeRefID()),
-		"GIT_REF_NAME=" + hook.RefName,
-		"GIT_REF_TYPE=" + hook.RefType,
-		"GIT_REPO_ID=" + hook.RepoID,
-		"GIT_REPO_OWNER=" + hook.Owner,
-		"GIT_REPO_NAME=" + hook.Repo,
-		"GIT_CLONE_URL=" + hook.HTTPSURL, // deprecated
-		"GIT_HTTPS_URL=" + hook.HTTPSURL,
-		"GIT_SSH_URL=" + hook.SSHURL,
+	for {
+		select {
+		case <-exited:
+			return
+		case <-timer.C:
+			job.mux.Lock()
+			idle := time.Since(job.lastOutput)
+			job.mux.Unlock()
+			if idle < idleTimeout {
+				timer.Reset(idleTimeout - idle)
+				continue
+			}
+			log.Printf("[%s] no output for %s", job.GitRef.GetRefID(), idleTimeout)
+			terminate(job, EndIdleTimeout, runOpts)
+			return
+		}
 	}
+}
 
-	// GIT_REPO_TRUSTED
-	// Set GIT_REPO_TRUSTED=TRUE if the repo matches exactly, or by pattern
-	repoID := strings.ToLower(hook.RepoID)
+// supersede kills the active job in favor of a newer rev of the same ref
+func supersede(job *Job, hook *webhooks.Ref, runOpts *options.ServerConfig) {
+	job.mux.Lock()
+	alreadyKilled := "" != job.Status
+	if value, ok := Pending.Load(hook.GetRefID()); ok {
+		job.SupersededBy = value.(*Job).ID
+	}
+	if !alreadyKilled {
+		job.Status = StatusSuperseded
+	}
+	job.mux.Unlock()
+	if alreadyKilled {
+		return
+	}
+
+	log.Printf("[%s] superseded by %s", job.GitRef, hook)
+	terminate(job, EndSuperseded, runOpts)
+}
+
+// terminate asks the job's whole process tree to stop (SIGTERM),
+// and makes it stop (SIGKILL) if it's still around after KillGracePeriod
+func terminate(job *Job, reason string, runOpts *options.ServerConfig) {
+	job.mux.Lock()
+	if "" != job.EndReason {
+		// already on its way out
+		job.mux.Unlock()
+		return
+	}
+	job.EndReason = reason
+	cmd := job.cmd
+	between := betweenStages(job)
+	job.mux.Unlock()
+
+	if nil == cmd.Process || between {
+		// the next stage won't start
+		return
+	}
+	if err := signalGroup(cmd, false); nil != err {
+		log.Printf("[%s] failed to terminate process: %v", job.GitRef.GetRefID(), err)
+	}
+	// children may outlive the script itself, so this happens either way
+	time.AfterFunc(runOpts.KillGracePeriod, func() {
+		_ = signalGroup(cmd, true)
+	})
+}
+
+// addPipelineStages adds the stages that come after the checkout: the steps
+// of the repo's pipeline file, or else its configured stages, or else deploy.sh
+func addPipelineStages(job *Job, conf *RepoConfig, checkoutDir string) error {
+	pipeline, ok, err := readPipeline(checkoutDir)
+	if nil != err {
+		return err
+	}
+
+	var stages []Stage
+	switch {
+	case ok:
+		stages = pipelineStages(pipeline, job.GitRef)
+	case len(conf.Stages) > 0:
+		stages = newStages(conf.Stages)
+	default:
+		stages = newStages([]StageConfig{{Name: "deploy"}})
+	}
+	job.mux.Lock()
+	job.Stages = append(job.Stages, stages...)
+	job.mux.Unlock()
+	return nil
+}
+
+// isTrusted is true if the repo matches the list of repos
+// that may run their own scripts, exactly or by pattern
+func isTrusted(repoList string, repoID string) bool {
+	repoID = strings.ToLower(repoID)
 	for _, repo := range strings.Fields(repoList) {
 		last := len(repo) - 1
 		if len(repo) < 0 {
@@ -524,14 +1338,50 @@ func getEnvs(addr, activeID string, repoList string, hook *webhooks.Ref) []strin
 			// github.com/whatever/*					MATCHES github.com/whatever/foo
 			// github.com/whatever/ProjectX-* MATCHES github.com/whatever/ProjectX-Foo
 			if strings.HasPrefix(repoID, repo[:last]) {
-				envs = append(envs, "GIT_REPO_TRUSTED=true")
-				break
+				return true
 			}
 		} else if repo == repoID {
-			envs = append(envs, "GIT_REPO_TRUSTED=true")
-			break
+			return true
 		}
 	}
+	return false
+}
+
+// hasScripts is true if the repo has its own directory in the scripts directory
+func hasScripts(scriptsPath string, repoID string) bool {
+	if "" == scriptsPath {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(scriptsPath, repoID))
+	return nil == err && info.IsDir()
+}
+
+// getEnvs returns the ENVs for a job's script, where callbackID
+// is the ID by which the job reports back (see SetReport)
+func getEnvs(addr, activeID, callbackID string, repoList string, hook *webhooks.Ref) []string {
+
+	port := strings.Split(addr, ":")[1]
+
+	envs := []string{
+		"GIT_DEPLOY_JOB_ID=" + activeID,
+		"GIT_DEPLOY_TIMESTAMP=" + hook.Timestamp.Format(time.RFC3339),
+		"GIT_DEPLOY_CALLBACK_URL=" + "http://localhost:" + port + "/api/local/jobs/" + callbackID,
+		"GIT_REV=" + hook.Rev,
+		"GIT_REF_NAME=" + hook.RefName,
+		"GIT_REF_TYPE=" + hook.RefType,
+		"GIT_REPO_ID=" + hook.RepoID,
+		"GIT_REPO_OWNER=" + hook.Owner,
+		"GIT_REPO_NAME=" + hook.Repo,
+		"GIT_CLONE_URL=" + hook.HTTPSURL, // deprecated
+		"GIT_HTTPS_URL=" + hook.HTTPSURL,
+		"GIT_SSH_URL=" + hook.SSHURL,
+	}
+
+	// GIT_REPO_TRUSTED
+	// Set GIT_REPO_TRUSTED=TRUE if the repo matches exactly, or by pattern
+	if isTrusted(repoList, hook.RepoID) {
+		envs = append(envs, "GIT_REPO_TRUSTED=true")
+	}
 
 	return envs
 }
@@ -548,62 +1398,117 @@ func remove(runOpts *options.ServerConfig, activeID webhooks.RefID /*, nokill bo
 		return
 	}
 	job := value.(*Job)
-	Actives.Delete(activeID)
 
-	if nil == job.cmd.ProcessState {
-		// is not yet finished
-		if nil != job.cmd.Process {
-			// but definitely was started
-			if err := job.cmd.Process.Kill(); nil != err {
-				log.Printf("error killing job:\n%v", err)
-			}
-		}
+	job.mux.Lock()
+	cmd := job.cmd
+	finished := job.finished
+	job.mux.Unlock()
+	// once cmd.Wait has returned it's finished, and only then may cmd.ProcessState be read
+	if !finished && nil != cmd.Process {
+		// is not yet finished, but definitely was started,
+		// and will come back through here once it has exited
+		log.Printf("[%s] killing job", activeID)
+		terminate(job, EndKilled, runOpts)
+		return
+	}
+	Actives.Delete(activeID)
+	if job.Promote && isActive(job) {
+		// it's done once it's removed by its last ID
+		return
 	}
-	if nil != job.cmd.ProcessState {
+
+	if nil != cmd.ProcessState {
 		//*job.ExitCode = job.cmd.ProcessState.ExitCode()
-		exitCode := job.cmd.ProcessState.ExitCode()
+		exitCode := cmd.ProcessState.ExitCode()
 		job.ExitCode = &exitCode
+		job.Signal = exitSignal(cmd.ProcessState)
+	}
+	if failed := failedStage(job); nil != failed {
+		// rather than whichever always-run stage came last
+		job.ExitCode = failed.ExitCode
+		job.Signal = failed.Signal
+		if nil != job.ExitCode && 0 == *job.ExitCode {
+			// failed after it exited, ex: its pipeline file didn't validate
+			job.ExitCode = nil
+		}
 	}
 	now := time.Now()
 	job.EndedAt = &now
+	job.mux.Lock()
+	if 0 == len(job.Stages) && nil != cmd.ProcessState {
+		// each stage's usage was added as it ended
+		addUsage(job, cmd.ProcessState)
+	}
+	job.Usage = endUsage(job, now)
+	// otherwise it was already superseded or interrupted
+	if "" == job.Status {
+		if nil != job.ExitCode && 0 == *job.ExitCode {
+			job.Status = StatusSucceeded
+		} else {
+			job.Status = StatusFailed
+		}
+	}
+	job.mux.Unlock()
 
-	// Switch ID to the more specific RevID
-	job.ID = string(job.GitRef.GetRevID())
 	// replace the text log with a json log
-	if jsonFile, err := getJobFile(runOpts.LogDir, job.GitRef, ".json"); nil != err {
+	writeJobLog(runOpts, job)
+	removeJournal(job, runOpts)
+	job.Logs = []Log{}
+
+	if StatusSucceeded == job.Status && !job.Promote {
+		rememberDeployed(job.GitRef)
+	}
+	storeRecent(job)
+
+	if StatusSucceeded == job.Status && !job.Promote {
+		triggerDownstream(job, runOpts)
+	}
+	scheduleRetry(job, runOpts)
+}
+
+// writeJobLog replaces the text log with a json log
+func writeJobLog(runOpts *options.ServerConfig, job *Job) {
+	jsonFile, err := getJobFile(runOpts.LogDir, job, ".json")
+	if nil != err {
 		// jsonFile.Name() should be the full path
 		log.Printf("[warn] could not create log file '%s': %v", runOpts.LogDir, err)
-	} else {
-		enc := json.NewEncoder(jsonFile)
-		enc.SetIndent("", "  ")
-		if err := enc.Encode(job); nil != err {
-			log.Printf("[warn] could not encode json log '%s': %v", jsonFile.Name(), err)
-		} else {
-			logdir, logname, _ := getJobFilePath(runOpts.LogDir, job.GitRef, ".log")
-			_ = os.Remove(filepath.Join(logdir, logname))
-		}
-		_ = jsonFile.Close()
+		return
 	}
-	job.Logs = []Log{}
 
-	// transition to RevID for non-active, non-pending jobs
-	job.ID = string(job.GitRef.GetRevID())
-	Recents.Store(job.GitRef.GetRevID(), job)
+	enc := json.NewEncoder(jsonFile)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(job); nil != err {
+		log.Printf("[warn] could not encode json log '%s': %v", jsonFile.Name(), err)
+	} else {
+		logdir, logname, _ := getJobFilePath(runOpts.LogDir, job, ".log")
+		_ = os.Remove(filepath.Join(logdir, logname))
+	}
+	_ = jsonFile.Close()
 }
 
 func expire(runOpts *options.ServerConfig) {
-	staleJobIDs := []webhooks.URLSafeRevID{}
+	staleJobIDs := []string{}
+	staleRevIDs := []webhooks.RevID{}
 
+	RecentRuns.Range(func(key, value interface{}) bool {
+		age := time.Since(value.(*Job).GitRef.Timestamp)
+		if age > runOpts.StaleJobAge {
+			staleJobIDs = append(staleJobIDs, key.(string))
+		}
+		return true
+	})
 	Recents.Range(func(key, value interface{}) bool {
-		revID := key.(webhooks.URLSafeRevID)
 		age := time.Since(value.(*Job).GitRef.Timestamp)
 		if age > runOpts.StaleJobAge {
-			staleJobIDs = append(staleJobIDs, revID)
+			staleRevIDs = append(staleRevIDs, key.(webhooks.RevID))
 		}
 		return true
 	})
 
-	for _, revID := range staleJobIDs {
+	for _, jobID := range staleJobIDs {
+		RecentRuns.Delete(jobID)
+	}
+	for _, revID := range staleRevIDs {
 		Recents.Delete(revID)
 	}
 }
@@ -2,9 +2,15 @@ package jobs
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,7 +31,7 @@ func init() {
 		Addr:              "localhost:4483",
 		ScriptsPath:       "./testdata",
 		LogDir:            "./test-logs/debounce",
-		TmpDir:            tmpDir,
+		BacklogDir:        tmpDir,
 		DebounceDelay:     25 * time.Millisecond,
 		DefaultMaxJobTime: 5 * time.Second, // very short
 		StaleJobAge:       5 * time.Minute,
@@ -35,6 +41,9 @@ func init() {
 	logDir, _ = filepath.Abs(runOpts.LogDir)
 
 	os.Setenv("GIT_DEPLOY_TEST_WAIT", "0.1")
+	// where a job of a ref named "orphan" says which child it started
+	childDir, _ := ioutil.TempDir("", "gitdeploy-children-*")
+	os.Setenv("GIT_DEPLOY_TEST_CHILD", childDir)
 	debounceDelay = 50 * time.Millisecond
 	jobDelay = 250 * time.Millisecond
 
@@ -195,7 +204,7 @@ func TestRecents(t *testing.T) {
 			Addr:          "localhost:4483",
 			ScriptsPath:   "./testdata",
 			LogDir:        "./test-logs/recents",
-			TmpDir:        tmpDir,
+			BacklogDir:    tmpDir,
 			DebounceDelay: 1 * time.Millisecond,
 			StaleJobAge:   5 * time.Minute,
 			StaleLogAge:   5 * time.Minute,
@@ -235,20 +244,21 @@ func TestRecents(t *testing.T) {
 	urlRefID := webhooks.URLSafeGitID(
 		base64.RawURLEncoding.EncodeToString([]byte(hook.GetRefID())),
 	)
-	j, err := LoadLogs(runOpts, urlRefID)
+	j, err := LoadLogs(runOpts, string(urlRefID))
 	if nil != err {
 		urlRevID := webhooks.URLSafeGitID(
 			base64.RawURLEncoding.EncodeToString([]byte(hook.GetRevID())),
 		)
 
-		j, err = LoadLogs(runOpts, urlRevID)
+		j, err = LoadLogs(runOpts, string(urlRevID))
 		if nil != err {
 			t.Errorf("error loading logs: %v", err)
 			return
 		}
 	}
 
-	if len(j.Logs) < 3 {
+	// the script says when it started and when it finished
+	if len(j.Logs) < 2 {
 		t.Errorf("should have logs from test deploy script: %#v", j.Logs)
 		t.Fail()
 		return
@@ -266,3 +276,2042 @@ func TestRecents(t *testing.T) {
 
 	//Stop()
 }
+
+func TestLoadBacklog(t *testing.T) {
+	backlogDir, _ := ioutil.TempDir("", "gitdeploy-backlog-*")
+	defer os.RemoveAll(backlogDir)
+
+	t8 := t0.Add(-30 * time.Second).Truncate(time.Second)
+	hook := webhooks.Ref{
+		Timestamp: t8,
+		RepoID:    "git.example.com/owner/backlog",
+		HTTPSURL:  "https://git.example.com/owner/backlog.git",
+		Rev:       "123456abcd",
+		RefName:   "master",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "backlog",
+	}
+	repoDir := filepath.Join(backlogDir, hook.RepoID)
+	_ = os.MkdirAll(repoDir, 0755)
+	b, _ := json.Marshal(hook)
+	// as if the server stopped just as the job was being picked up
+	if err := ioutil.WriteFile(filepath.Join(repoDir, "master.json.cur"), b, 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	// written by an older version, as a bare ref
+	pendings := loadBacklog(&options.ServerConfig{BacklogDir: backlogDir})
+	if 1 != len(pendings) {
+		t.Fatalf("should restore exactly one backlog item, not %d", len(pendings))
+	}
+	restored := pendings[0].GitRef
+	if hook.GetRefID() != restored.GetRefID() || hook.Rev != restored.Rev {
+		t.Errorf("should restore the same ref: %#v", restored)
+	}
+	if !t8.Equal(restored.Timestamp) {
+		t.Errorf("should keep the original timestamp %s, not %s", t8, restored.Timestamp)
+	}
+	if _, err := os.Stat(filepath.Join(repoDir, "master.json")); nil != err {
+		t.Errorf("should put the interrupted backlog file back in place: %v", err)
+	}
+}
+
+func TestRecoverJobs(t *testing.T) {
+	backlogDir, _ := ioutil.TempDir("", "gitdeploy-backlog-*")
+	defer os.RemoveAll(backlogDir)
+	logDir, _ := ioutil.TempDir("", "gitdeploy-logs-*")
+	defer os.RemoveAll(logDir)
+	opts := &options.ServerConfig{
+		BacklogDir:    backlogDir,
+		LogDir:        logDir,
+		StaleLogAge:   5 * time.Minute,
+		ExpiredLogAge: 10 * time.Minute,
+	}
+
+	now := time.Now()
+	hook := &webhooks.Ref{
+		Timestamp: t0.Add(-20 * time.Second),
+		RepoID:    "git.example.com/owner/crash",
+		HTTPSURL:  "https://git.example.com/owner/crash.git",
+		Rev:       "1234567abc",
+		RefName:   "master",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "crash",
+	}
+	saveJournal(&Job{StartedAt: &now, GitRef: hook}, opts)
+	f, _ := getJobFile(logDir, &Job{GitRef: hook}, ".log")
+	_, _ = f.Write([]byte("building...\nhalfway there\n"))
+	_ = f.Close()
+
+	interrupted := recoverJobs(opts)
+	if 1 != len(interrupted) {
+		t.Fatalf("should find exactly one interrupted job, not %d", len(interrupted))
+	}
+
+	oldJobs, _ := WalkLogs(opts)
+	if 1 != len(oldJobs) {
+		t.Fatalf("should replace the partial text log with a json log, found %d logs", len(oldJobs))
+	}
+	j := oldJobs[0]
+	if StatusInterrupted != j.Status || nil != j.ExitCode {
+		t.Errorf("should be marked as interrupted without an exit code: %#v", j)
+	}
+	if nil == j.EndedAt {
+		t.Errorf("should have an end time")
+	}
+
+	// renamed to have the full rev, as it was logged before jobs had IDs
+	logs, err := openJobFile(logDir, j, ".json")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+	j = &Job{}
+	_ = json.NewDecoder(logs).Decode(j)
+	if 2 != len(j.Logs) || "halfway there\n" != j.Logs[1].Text {
+		t.Errorf("should keep the partial log: %#v", j.Logs)
+	}
+
+	if 0 != len(recoverJobs(opts)) {
+		t.Errorf("should only recover a job once")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	hook := webhooks.Ref{
+		Timestamp: t0.Add(-15 * time.Second),
+		RepoID:    "git.example.com/owner/idle",
+		HTTPSURL:  "https://git.example.com/owner/idle.git",
+		Rev:       "abcdef1234",
+		RefName:   "master",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "idle",
+	}
+	repoConfigsMux.Lock()
+	// the test script is quiet for GIT_DEPLOY_TEST_WAIT (0.1s)
+	repoConfigs[hook.RepoID] = &RepoConfig{IdleTimeout: Duration(50 * time.Millisecond)}
+	repoConfigsMux.Unlock()
+
+	Debounce(hook)
+
+	t.Log("sleep so job can debounce, start, and go idle")
+	time.Sleep(debounceDelay)
+	time.Sleep(jobDelay)
+
+	value, ok := Recents.Load(hook.GetRevID())
+	if !ok {
+		t.Fatalf("should have killed the idle job")
+	}
+	j := value.(*Job)
+	if EndIdleTimeout != j.EndReason || StatusFailed != j.Status {
+		t.Errorf("should end with %q, not %q (%s)", EndIdleTimeout, j.EndReason, j.Status)
+	}
+}
+
+// running tells whether the process is still around (a zombie has exited,
+// it just hasn't been reaped)
+func running(pid string) bool {
+	b, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	if nil != err {
+		return false
+	}
+	fields := strings.Fields(string(b))
+	return len(fields) > 2 && "Z" != fields[2]
+}
+
+func TestKillChildren(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); nil != err {
+		t.Skip("needs /proc to tell whether the child is still running")
+	}
+
+	for _, name := range []string{"orphan-kill", "orphan-timeout"} {
+		hook := webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    "git.example.com/owner/" + name,
+			HTTPSURL:  "https://git.example.com/owner/" + name + ".git",
+			Rev:       fmt.Sprintf("%x", time.Now().UnixNano()),
+			RefName:   "orphan",
+			RefType:   "branch",
+			Owner:     "owner",
+			Repo:      name,
+		}
+		refID := webhooks.New(hook).GetRefID()
+		if "orphan-timeout" == name {
+			repoConfigsMux.Lock()
+			repoConfigs[hook.RepoID] = &RepoConfig{MaxJobTime: Duration(300 * time.Millisecond)}
+			repoConfigsMux.Unlock()
+		}
+		pidFile := filepath.Join(os.Getenv("GIT_DEPLOY_TEST_CHILD"), name+".pid")
+		_ = os.Remove(pidFile)
+
+		Debounce(hook)
+		var pid string
+		for i := 0; i < 50 && "" == pid; i++ {
+			time.Sleep(jobDelay / 5)
+			b, _ := ioutil.ReadFile(pidFile)
+			pid = strings.TrimSpace(string(b))
+		}
+		if "" == pid || !running(pid) {
+			t.Fatalf("[%s] the script should have started a child", name)
+		}
+		if "orphan-kill" == name {
+			Remove(refID)
+		}
+
+		// the child sleeps for 7s, so either it was killed or it held up the job
+		var ended bool
+		for i := 0; i < 50 && !ended; i++ {
+			time.Sleep(jobDelay / 5)
+			_, active := Actives.Load(refID)
+			ended = !active && !running(pid)
+		}
+		if !ended {
+			t.Fatalf("[%s] should have killed both the script and its child", name)
+		}
+		value, ok := Recents.Load(webhooks.New(hook).GetRevID())
+		if !ok || StatusFailed != value.(*Job).Status {
+			t.Errorf("[%s] should have failed", name)
+		}
+	}
+	repoConfigsMux.Lock()
+	delete(repoConfigs, "git.example.com/owner/orphan-timeout")
+	repoConfigsMux.Unlock()
+}
+
+func TestSupersede(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); nil != err {
+		t.Skip("needs /proc to tell whether the child is still running")
+	}
+	// once the job loop is running, it's done loading the repo configs
+	checkQueue <- struct{}{}
+	repoID := "git.example.com/owner/superseded"
+	repoConfigsMux.Lock()
+	// the first push runs right away, and any other would wait for 5s
+	repoConfigs[repoID] = &RepoConfig{
+		Supersede: true,
+		Debounce:  &DebounceConfig{Delay: Duration(5 * time.Second), Leading: true},
+	}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		delete(repoConfigs, repoID)
+		repoConfigsMux.Unlock()
+	}()
+	push := func(refName string) webhooks.Ref {
+		return webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    repoID,
+			HTTPSURL:  "https://" + repoID + ".git",
+			// unique to this run, since old logs are read back into Recents
+			Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+			RefName: refName,
+			RefType: "branch",
+			Owner:   "owner",
+			Repo:    "superseded",
+		}
+	}
+	active := func(refID webhooks.RefID) *Job {
+		if value, ok := Actives.Load(refID); ok {
+			return value.(*Job)
+		}
+		return nil
+	}
+
+	// the script's child sleeps for 7s, unless it's killed along with the script
+	older := push("orphan")
+	refID := webhooks.New(older).GetRefID()
+	pidFile := filepath.Join(os.Getenv("GIT_DEPLOY_TEST_CHILD"), "superseded.pid")
+	_ = os.Remove(pidFile)
+	Debounce(older)
+	var pid string
+	for i := 0; i < 50 && "" == pid; i++ {
+		time.Sleep(jobDelay / 5)
+		b, _ := ioutil.ReadFile(pidFile)
+		pid = strings.TrimSpace(string(b))
+	}
+	if "" == pid || !running(pid) {
+		t.Fatalf("the script should have started a child")
+	}
+
+	newer := push("orphan")
+	Debounce(newer)
+	var job *Job
+	for i := 0; i < 50 && nil == job; i++ {
+		time.Sleep(jobDelay / 25)
+		if j := active(refID); nil != j && newer.Rev == j.GitRef.Rev {
+			job = j
+		}
+	}
+	if nil == job {
+		t.Fatalf("the newer rev should have started right away")
+	}
+	if running(pid) {
+		t.Errorf("should have killed the superseded job's child")
+	}
+	value, ok := Recents.Load(webhooks.New(older).GetRevID())
+	if !ok {
+		t.Fatalf("the superseded job should have ended")
+	}
+	j := value.(*Job)
+	if StatusSuperseded != j.Status || EndSuperseded != j.EndReason || job.ID != j.SupersededBy {
+		t.Errorf("should have been superseded by %s: %#v", job.ID, j)
+	}
+	Remove(refID)
+	for i := 0; i < 50 && nil != active(refID); i++ {
+		time.Sleep(jobDelay / 5)
+	}
+
+	// a promotion is never superseded
+	promoted := push("main")
+	promotedID := webhooks.New(promoted).GetRefID()
+	Promote(promoted, "production")
+	promotion := active(promotedID)
+	for i := 0; i < 20 && nil == promotion; i++ {
+		time.Sleep(jobDelay / 25)
+		promotion = active(promotedID)
+	}
+	if nil == promotion || !promotion.Promote {
+		t.Fatalf("should have started the promotion")
+	}
+	Debounce(push("main"))
+	time.Sleep(jobDelay / 5)
+	promotion.mux.Lock()
+	status := promotion.Status
+	promotion.mux.Unlock()
+	if active(promotedID) != promotion || StatusSuperseded == status {
+		t.Errorf("a push should not supersede a promotion")
+	}
+	for i := 0; i < 50 && promotion == active(promotedID); i++ {
+		time.Sleep(jobDelay / 5)
+	}
+	Cancel(runOpts, promotedID)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	conf := &RetryConfig{
+		MaxAttempts: 3,
+		Backoff:     Duration(10 * time.Second),
+		MaxBackoff:  Duration(30 * time.Second),
+		ExitCodes:   []int{75},
+	}
+	for attempt, backoff := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 30 * time.Second,
+		4: 30 * time.Second,
+	} {
+		if d := retryBackoff(conf, attempt); backoff != d {
+			t.Errorf("attempt %d should back off %s, not %s", attempt, backoff, d)
+		}
+	}
+
+	transient, other := 75, 1
+	job := &Job{Status: StatusFailed, ExitCode: &transient, Attempt: 1}
+	if !shouldRetry(job, conf) {
+		t.Errorf("should retry a transient failure")
+	}
+	job.Attempt = 3
+	if shouldRetry(job, conf) {
+		t.Errorf("should not retry after the last attempt")
+	}
+	job.Attempt = 1
+	job.ExitCode = &other
+	if shouldRetry(job, conf) {
+		t.Errorf("should only retry the listed exit codes")
+	}
+	job.ExitCode = &transient
+	job.EndReason = EndKilled
+	if shouldRetry(job, conf) {
+		t.Errorf("should not retry a job that was killed on purpose")
+	}
+}
+
+func TestResolveInputs(t *testing.T) {
+	conf := &RepoConfig{}
+	b := []byte(`{ "inputs": [
+		{ "name": "clear_cache", "type": "boolean", "default": false },
+		{ "name": "target", "options": ["www1", "www2"] },
+		{ "name": "workers", "type": "number", "default": 2 }
+	] }`)
+	if err := json.Unmarshal(b, conf); nil != err {
+		t.Fatal(err)
+	}
+	if err := conf.validate(); nil != err {
+		t.Fatal(err)
+	}
+
+	inputs, err := conf.resolveInputs(map[string]interface{}{
+		"clear_cache": "true",
+		"target":      "www2",
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "true" != inputs["clear_cache"] || "www2" != inputs["target"] || "2" != inputs["workers"] {
+		t.Errorf("should parse the given values and fill in the defaults: %#v", inputs)
+	}
+
+	for _, given := range []map[string]interface{}{
+		{},                                     // target is required
+		{"target": "www3"},                     // not an option
+		{"target": "www1", "workers": "many"},  // not a number
+		{"target": "www1", "clear_cash": true}, // not declared
+	} {
+		if _, err := conf.resolveInputs(given); nil == err {
+			t.Errorf("should reject %#v", given)
+		}
+	}
+
+	if "GIT_DEPLOY_INPUT_CLEAR_CACHE" != InputEnv("clear_cache") {
+		t.Errorf("unexpected env name %s", InputEnv("clear_cache"))
+	}
+}
+
+func TestFindDeployed(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "gitdeploy-rollback-*")
+	defer os.RemoveAll(tmpDir)
+	opts := *runOpts
+	opts.LogDir = tmpDir
+
+	write := func(ts time.Time, rev, status string) {
+		job := &Job{
+			GitRef: &webhooks.Ref{
+				Timestamp: ts,
+				RepoID:    "git.example.com/owner/rollback",
+				HTTPSURL:  "https://git.example.com/owner/rollback.git",
+				Rev:       rev,
+				RefName:   "master",
+				RefType:   "branch",
+				Owner:     "owner",
+				Repo:      "rollback",
+			},
+			Status: status,
+			Inputs: map[string]string{"target": "www1"},
+		}
+		writeJobLog(&opts, job)
+	}
+	t1 := t0.Add(-48 * time.Hour)
+	t2 := t0.Add(-47 * time.Hour)
+	write(t1, "aaaaaaa0123", StatusSucceeded)
+	write(t2, "aaaaaaa0123", StatusFailed)
+	write(t2, "bbbbbbb0123", StatusFailed)
+
+	revID, err := ParseRevID(base64.RawURLEncoding.EncodeToString(
+		[]byte("git.example.com/owner/rollback#aaaaaaa"),
+	))
+	if nil != err {
+		t.Fatal(err)
+	}
+	job, err := FindDeployed(&opts, revID, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !job.GitRef.Timestamp.Equal(t1) || "www1" != job.Inputs["target"] {
+		t.Errorf("should replay the successful deploy of the rev: %#v", job)
+	}
+
+	revID = webhooks.RevID("git.example.com/owner/rollback#bbbbbbb")
+	if _, err := FindDeployed(&opts, revID, false); ErrRevFailed != err {
+		t.Errorf("should refuse a rev that never deployed successfully, not %v", err)
+	}
+	if _, err := FindDeployed(&opts, revID, true); nil != err {
+		t.Errorf("should replay a failed rev when forced: %v", err)
+	}
+
+	revID = webhooks.RevID("git.example.com/owner/rollback#ccccccc")
+	if _, err := FindDeployed(&opts, revID, true); ErrUnknownJob != err {
+		t.Errorf("should not find a rev that was never deployed, not %v", err)
+	}
+}
+
+func TestJobIDs(t *testing.T) {
+	ids := []string{}
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, NewJobID())
+	}
+	for i := range ids {
+		if !isJobID(ids[i]) {
+			t.Fatalf("should be a job id: %q", ids[i])
+		}
+		if i > 0 && ids[i-1] >= ids[i] {
+			t.Fatalf("should be unique and in order: %q >= %q", ids[i-1], ids[i])
+		}
+	}
+
+	hook := &webhooks.Ref{
+		Timestamp: t0.Truncate(time.Second),
+		RepoID:    "git.example.com/owner/repo",
+		Rev:       "abcdef7890",
+		RefName:   "v1.0.0",
+	}
+	rerun := &Job{ID: ids[1], GitRef: hook}
+	name, ok := parseJobLogName(getJobLogName(rerun) + ".json")
+	if !ok || ids[1] != name.ID || "v1.0.0" != name.RefName || "abcdef7890" != name.Rev {
+		t.Errorf("should read back the log name: %#v", name)
+	}
+	if getJobLogName(&Job{ID: ids[0], GitRef: hook}) == getJobLogName(rerun) {
+		t.Errorf("re-runs of the same rev should have their own logs")
+	}
+
+	branch := *hook
+	branch.RefName = "master"
+	legacy := getJobLogName(&Job{GitRef: &branch})
+	name, ok = parseJobLogName(legacy + ".log")
+	if !ok || "" != name.ID || !hook.Timestamp.Equal(name.Timestamp) {
+		t.Errorf("should read a log name from before jobs had IDs: %#v", name)
+	}
+	if id := legacyJobID(legacy); !isJobID(id) || id != legacyJobID(legacy) {
+		t.Errorf("should give old logs the same job id every time: %q", id)
+	}
+}
+
+func TestFullRevs(t *testing.T) {
+	logDir, _ := ioutil.TempDir("", "gitdeploy-logs-*")
+	defer os.RemoveAll(logDir)
+	opts := &options.ServerConfig{
+		LogDir:        logDir,
+		StaleLogAge:   5 * time.Minute,
+		ExpiredLogAge: 10 * time.Minute,
+	}
+
+	rev := "abcdef1234567890abcdef1234567890abcdef12"
+	hook := &webhooks.Ref{
+		Timestamp: t0.Add(-10 * time.Second),
+		RepoID:    "git.example.com/owner/fullrev",
+		HTTPSURL:  "https://git.example.com/owner/fullrev.git",
+		Rev:       rev,
+		RefName:   "master",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "fullrev",
+	}
+	if "git.example.com/owner/fullrev#"+rev != string(hook.GetRevID()) {
+		t.Errorf("should keep the full rev in the RevID: %s", hook.GetRevID())
+	}
+
+	// logged before jobs had IDs, by the first 7 characters of the rev
+	writeJobLog(opts, &Job{GitRef: hook, Status: StatusSucceeded})
+	legacy := getJobLogName(&Job{GitRef: hook})
+
+	oldJobs, _ := WalkLogs(opts)
+	if 1 != len(oldJobs) {
+		t.Fatalf("should find exactly one log, not %d", len(oldJobs))
+	}
+	j := oldJobs[0]
+	if legacyJobID(legacy) != j.ID || rev != j.GitRef.Rev {
+		t.Errorf("should keep the ID that the old log name gave it: %#v", j)
+	}
+	if _, err := os.Stat(filepath.Join(logDir, hook.RepoID, legacy+".json")); !os.IsNotExist(err) {
+		t.Errorf("should rename the old log")
+	}
+	f, err := openJobFile(logDir, j, ".json")
+	if nil != err {
+		t.Fatalf("should rename the log to have the full rev and ID: %v", err)
+	}
+	_ = f.Close()
+
+	revID := webhooks.RevID("git.example.com/owner/fullrev#abcdef12")
+	if deployed := readDeployed(logDir, revID); 1 != len(deployed) || j.ID != deployed[0].ID {
+		t.Errorf("should find the log by an abbreviated rev: %#v", deployed)
+	}
+
+	// ex: a tag without commits
+	norev := *hook
+	norev.Rev = ""
+	_ = getJobLogName(&Job{GitRef: &norev})
+	_ = getJobLogName(&Job{ID: NewJobID(), GitRef: &norev})
+	if "git.example.com/owner/fullrev#master@" != norev.String() {
+		t.Errorf("should show a missing rev as empty, not %q", norev.String())
+	}
+}
+
+func TestRefNames(t *testing.T) {
+	for _, refName := range []string{"master", "feature/login", "v1.0.0", "release/2.x", "50%/..", "tmp-wip"} {
+		escaped := escapeRefName(refName)
+		if strings.ContainsAny(escaped, "/.") {
+			t.Errorf("should escape slashes and dots: %q => %q", refName, escaped)
+		}
+		if refName != unescapeRefName(escaped) {
+			t.Errorf("should round-trip %q, not %q", refName, unescapeRefName(escaped))
+		}
+	}
+	if "master" != escapeRefName("master") {
+		t.Errorf("should keep simple names the same as before")
+	}
+
+	logDir, _ := ioutil.TempDir("", "gitdeploy-logs-*")
+	defer os.RemoveAll(logDir)
+	backlogDir, _ := ioutil.TempDir("", "gitdeploy-backlog-*")
+	defer os.RemoveAll(backlogDir)
+	opts := &options.ServerConfig{
+		LogDir:        logDir,
+		BacklogDir:    backlogDir,
+		StaleLogAge:   5 * time.Minute,
+		ExpiredLogAge: 10 * time.Minute,
+	}
+
+	hook := &webhooks.Ref{
+		Timestamp: t0.Add(-10 * time.Second).Truncate(time.Second),
+		RepoID:    "git.example.com/owner/refnames",
+		HTTPSURL:  "https://git.example.com/owner/refnames.git",
+		Rev:       "abcdef1234567890abcdef1234567890abcdef12",
+		RefName:   "feature/login.v2",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "refnames",
+	}
+	job := &Job{ID: NewJobID(), GitRef: hook, Status: StatusSucceeded}
+	writeJobLog(opts, job)
+
+	oldJobs, _ := WalkLogs(opts)
+	if 1 != len(oldJobs) {
+		t.Fatalf("should find exactly one log, not %d", len(oldJobs))
+	}
+	j := oldJobs[0]
+	if job.ID != j.ID || hook.RefName != j.GitRef.RefName || hook.RepoID != j.GitRef.RepoID {
+		t.Errorf("should read the branch back from the log: %#v", j.GitRef)
+	}
+
+	storeRecent(j)
+	defer func() {
+		RecentRuns.Delete(j.ID)
+		Recents.Delete(hook.GetRevID())
+	}()
+	if loaded, err := LoadLogs(opts, j.ID); nil != err || hook.RefName != loaded.GitRef.RefName {
+		t.Errorf("should load the logs of a branch with a slash: %v", err)
+	}
+
+	saveBacklog(&Job{GitRef: hook}, opts)
+	Pending.Delete(hook.GetRefID())
+	pendings := loadBacklog(opts)
+	if 1 != len(pendings) || hook.GetRefID() != pendings[0].GitRef.GetRefID() {
+		t.Errorf("should restore the backlog of a branch with a slash: %#v", pendings)
+	}
+}
+
+func TestStages(t *testing.T) {
+	bad := &RepoConfig{Stages: []StageConfig{{Name: "build"}, {Name: "../deploy"}}}
+	if err := bad.validate(); nil == err {
+		t.Errorf("should not allow a stage name that isn't a file name")
+	}
+
+	hook := webhooks.Ref{
+		Timestamp: t0.Add(-20 * time.Second),
+		RepoID:    "git.example.com/owner/stages",
+		HTTPSURL:  "https://git.example.com/owner/stages.git",
+		Rev:       "abcdef1234",
+		RefName:   "master",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "stages",
+	}
+	repoConfigsMux.Lock()
+	// the test script exits 3 for the stage named "fail"
+	repoConfigs[hook.RepoID] = &RepoConfig{Stages: []StageConfig{
+		{Name: "build"},
+		{Name: "fail"},
+		{Name: "deploy"},
+		{Name: "cleanup", Always: true},
+	}}
+	repoConfigsMux.Unlock()
+
+	Debounce(hook)
+
+	t.Log("sleep so job can debounce, and run each stage")
+	time.Sleep(debounceDelay)
+	time.Sleep(3 * jobDelay)
+
+	value, ok := Recents.Load(hook.GetRevID())
+	if !ok {
+		t.Fatalf("should have finished the job")
+	}
+	j := value.(*Job)
+	if StatusFailed != j.Status || nil == j.ExitCode || 3 != *j.ExitCode {
+		t.Errorf("should fail with the exit code of the failed stage, not %s", j.Status)
+	}
+	statuses := []string{}
+	for _, stage := range j.Stages {
+		statuses = append(statuses, stage.Name+":"+stage.Status)
+	}
+	expected := "build:succeeded fail:failed deploy:skipped cleanup:succeeded"
+	if expected != strings.Join(statuses, " ") {
+		t.Errorf("should be %q, not %q", expected, strings.Join(statuses, " "))
+	}
+	if nil == j.Stages[0].StartedAt || nil == j.Stages[0].EndedAt || nil != j.Stages[2].StartedAt {
+		t.Errorf("should time the stages that ran, and only those: %#v", j.Stages)
+	}
+
+	logged, err := LoadLogs(runOpts, j.ID)
+	if nil != err {
+		t.Fatal(err)
+	}
+	stages := map[string]bool{}
+	for _, l := range logged.Logs {
+		stages[l.Stage] = true
+	}
+	if !stages["build"] || !stages["cleanup"] || stages["deploy"] {
+		t.Errorf("should log which stage wrote each line: %v", stages)
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	errs := map[string]string{
+		`{ "steps": [ { "name": "build", "run": "make" ] }`:                          "line 1, column 47: invalid character ']'",
+		"{\n  \"steps\": [\n    { \"name\": \"build\", \"rnu\": \"make\" }\n  ]\n}":  `line 3, column 24: unknown field "rnu"`,
+		`{ "steps": [ { "name": "build" } ] }`:                                       "steps[0] (build).run: is required",
+		`{ "steps": [ { "name": "build", "run": "make", "timeout": "5x" } ] }`:       "line 1, column 59: time: ",
+		`{ "steps": [ { "name": "build", "run": "make", "timeout": 5 } ] } {}`:       "unexpected data after the pipeline",
+		`{ "steps": [ { "name": "build", "run": "make", "artifacts": ["../x"] } ] }`: `steps[0] (build).artifacts: "../x" should be a path in the repo`,
+		`{ "steps": [ { "name": "checkout", "run": "git clone" } ] }`:                `is done by gitdeploy itself`,
+		`{ "env": { "NO-DASH": "x" }, "steps": [ { "name": "a", "run": "b" } ] }`:    `env: "NO-DASH" should be`,
+	}
+	for text, expected := range errs {
+		_, err := parsePipeline([]byte(text))
+		if nil == err || !strings.Contains(err.Error(), expected) {
+			t.Errorf("should fail with %q, not %v", expected, err)
+		}
+	}
+
+	pipeline, err := parsePipeline([]byte(`{ "steps": [
+		{ "name": "build", "run": "make" },
+		{ "name": "deploy", "run": "make deploy", "branches": ["main", "release/*"], "tags": ["v*"] }
+	] }`))
+	if nil != err {
+		t.Fatal(err)
+	}
+	deploy := &pipeline.Steps[1]
+	for refName, refType := range map[string]string{"main": "branch", "release/1.x": "branch", "v1.0.0": "tag"} {
+		if !deploy.matches(&webhooks.Ref{RefName: refName, RefType: refType}) {
+			t.Errorf("should deploy %s %s", refType, refName)
+		}
+	}
+	for refName, refType := range map[string]string{"feature/login": "branch", "main": "tag"} {
+		if deploy.matches(&webhooks.Ref{RefName: refName, RefType: refType}) {
+			t.Errorf("should not deploy %s %s", refType, refName)
+		}
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	// once the job loop is running, it's done loading the repo configs
+	checkQueue <- struct{}{}
+	staged := "git.example.com/owner/unstartable-stages"
+	repoConfigsMux.Lock()
+	repoConfigs[staged] = &RepoConfig{Stages: []StageConfig{{Name: "build"}, {Name: "deploy"}}}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		delete(repoConfigs, staged)
+		repoConfigsMux.Unlock()
+	}()
+
+	// an ENV longer than the kernel allows, so that the script can't be started
+	inputs := map[string]string{"HUGE": strings.Repeat("x", 256*1024)}
+	for _, repoID := range []string{"git.example.com/owner/unstartable", staged} {
+		hook := webhooks.New(webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    repoID,
+			HTTPSURL:  "https://" + repoID + ".git",
+			// unique to this run, since old logs are read back into Recents
+			Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+			RefName: "main",
+			RefType: "branch",
+			Owner:   "owner",
+			Repo:    path.Base(repoID),
+		})
+		pending := Deploy(hook, "tester", inputs, true)
+
+		var j *Job
+		for i := 0; i < 50 && nil == j; i++ {
+			time.Sleep(jobDelay / 25)
+			if value, ok := Recents.Load(hook.GetRevID()); ok {
+				j = value.(*Job)
+			}
+		}
+		if nil == j {
+			t.Fatalf("[%s] a job that couldn't start should still be recorded", repoID)
+		}
+		if pending.ID != j.ID || StatusFailed != j.Status || nil == j.EndedAt {
+			t.Errorf("[%s] should have failed: %#v", repoID, j)
+		}
+		if staged == repoID && (0 == len(j.Stages) || !strings.Contains(j.Stages[0].Error, "argument list too long")) {
+			t.Errorf("[%s] should say why the first stage didn't start: %#v", repoID, j.Stages)
+		}
+
+		logged, err := LoadLogs(runOpts, j.ID)
+		if nil != err {
+			t.Fatalf("[%s] should have written a json log: %v", repoID, err)
+		}
+		var found bool
+		for _, l := range logged.Logs {
+			if l.Stderr && strings.Contains(l.Text, "failed to exec") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("[%s] should log why it didn't start: %#v", repoID, logged.Logs)
+		}
+		logDir, logName, _ := getJobFilePath(runOpts.LogDir, j, ".log")
+		if _, err := os.Stat(filepath.Join(logDir, logName)); !os.IsNotExist(err) {
+			t.Errorf("[%s] should have replaced the text log: %v", repoID, err)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	repoDir, _ := ioutil.TempDir("", "gitdeploy-repo-*")
+	defer os.RemoveAll(repoDir)
+	_ = os.MkdirAll(filepath.Join(repoDir, ".gitdeploy"), 0755)
+	pipeline := `{
+  "env": { "GREETING": "hello" },
+  "steps": [
+    { "name": "build", "run": "mkdir -p dist && echo \"$GREETING\" > dist/out.txt", "artifacts": ["dist/*.txt"] },
+    { "name": "check", "run": "sleep 5", "timeout": "100ms" },
+    { "name": "deploy", "run": "echo deployed", "branches": ["production"], "always": true },
+    { "name": "cleanup", "run": "echo cleaned up", "always": true }
+  ]
+}`
+	if err := ioutil.WriteFile(filepath.Join(repoDir, PipelineFile), []byte(pipeline), 0644); nil != err {
+		t.Fatal(err)
+	}
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", repoDir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if nil != err {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+	git("symbolic-ref", "HEAD", "refs/heads/master")
+	git("add", ".")
+	git("commit", "--quiet", "-m", "add pipeline")
+
+	hook := webhooks.Ref{
+		Timestamp: t0.Add(-25 * time.Second),
+		RepoID:    "git.example.com/owner/pipeline",
+		HTTPSURL:  repoDir,
+		Rev:       git("rev-parse", "HEAD"),
+		RefName:   "master",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "pipeline",
+	}
+	// the repo ID is from the URL, which is a local path
+	hook = *webhooks.New(hook)
+	runOpts.RepoList = hook.RepoID
+	runOpts.Pipelines = true
+	defer func() {
+		runOpts.RepoList = ""
+		runOpts.Pipelines = false
+	}()
+
+	Debounce(hook)
+
+	t.Log("wait for the job to check out the repo and run its pipeline")
+	var j *Job
+	for i := 0; i < 50 && nil == j; i++ {
+		time.Sleep(jobDelay / 5)
+		if value, ok := Recents.Load(hook.GetRevID()); ok {
+			j = value.(*Job)
+		}
+	}
+	if nil == j {
+		t.Fatalf("should have finished the job")
+	}
+
+	statuses := []string{}
+	for _, stage := range j.Stages {
+		statuses = append(statuses, stage.Name+":"+stage.Status)
+	}
+	expected := "checkout:succeeded build:succeeded check:failed deploy:skipped cleanup:succeeded"
+	if expected != strings.Join(statuses, " ") {
+		t.Fatalf("should be %q, not %q", expected, strings.Join(statuses, " "))
+	}
+	if StatusFailed != j.Status || EndTimeout != j.Stages[2].EndReason || "" != j.EndReason {
+		t.Errorf("should fail the job by the step's own timeout: %#v", j.Stages[2])
+	}
+	if 1 != len(j.Stages[1].Artifacts) || "dist/out.txt" != j.Stages[1].Artifacts[0] {
+		t.Fatalf("should list the step's artifacts: %#v", j.Stages[1].Artifacts)
+	}
+	artifactPath, err := ArtifactPath(runOpts, j.ID, "/../"+j.Stages[1].Artifacts[0])
+	if nil != err {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(artifactPath); "hello\n" != string(b) {
+		t.Errorf("should save the artifact, with the pipeline's env: %q", string(b))
+	}
+
+	// a pipeline that doesn't validate fails the job, and says why
+	git("checkout", "--quiet", "-b", "broken")
+	broken := `{ "steps": [ { "name": "build" } ] }`
+	_ = ioutil.WriteFile(filepath.Join(repoDir, PipelineFile), []byte(broken), 0644)
+	git("commit", "--quiet", "-am", "break pipeline")
+	hook.RefName = "broken"
+	hook.Rev = git("rev-parse", "HEAD")
+
+	Debounce(hook)
+
+	j = nil
+	for i := 0; i < 50 && nil == j; i++ {
+		time.Sleep(jobDelay / 5)
+		if value, ok := Recents.Load(hook.GetRevID()); ok {
+			j = value.(*Job)
+		}
+	}
+	if nil == j {
+		t.Fatalf("should have finished the job")
+	}
+	expectedErr := PipelineFile + ": steps[0] (build).run: is required"
+	if StatusFailed != j.Status || 1 != len(j.Stages) || expectedErr != j.Stages[0].Error {
+		t.Errorf("should fail the checkout with %q: %#v", expectedErr, j.Stages)
+	}
+
+	// without --pipelines, deploy.sh is the whole job (and clones as it will)
+	runOpts.Pipelines = false
+	git("commit", "--quiet", "--allow-empty", "-m", "without pipelines")
+	hook.Rev = git("rev-parse", "HEAD")
+
+	Debounce(hook)
+
+	j = nil
+	for i := 0; i < 50 && nil == j; i++ {
+		time.Sleep(jobDelay / 5)
+		if value, ok := Recents.Load(hook.GetRevID()); ok {
+			j = value.(*Job)
+		}
+	}
+	if nil == j {
+		t.Fatalf("should have finished the job")
+	}
+	if StatusSucceeded != j.Status || 0 != len(j.Stages) {
+		t.Errorf("should run deploy.sh without a checkout stage: %s %#v", j.Status, j.Stages)
+	}
+}
+
+func TestDownstream(t *testing.T) {
+	configs := map[string]*RepoConfig{
+		"git.example.com/owner/a": {Downstream: []DownstreamConfig{{After: "main", Deploy: "git.example.com/owner/b#main"}}},
+		"git.example.com/owner/b": {Downstream: []DownstreamConfig{{After: "main", Deploy: "git.example.com/owner/a#main"}}},
+	}
+	expected := "downstream triggers loop: git.example.com/owner/a#main -> git.example.com/owner/b#main -> git.example.com/owner/a#main"
+	if err := findDownstreamLoop(configs); nil == err || expected != err.Error() {
+		t.Errorf("should find the loop %q, not %v", expected, err)
+	}
+	configs["git.example.com/owner/b"].Downstream[0].After = "dev"
+	if err := findDownstreamLoop(configs); nil != err {
+		t.Errorf("should allow a#main -> b#main and b#dev -> a#main: %v", err)
+	}
+
+	up := webhooks.Ref{
+		Timestamp: t0.Add(-30 * time.Second),
+		RepoID:    "git.example.com/owner/api",
+		HTTPSURL:  "https://git.example.com/owner/api.git",
+		// unique to this run, since old logs are read back into Recents
+		Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+		RefName: "master",
+		RefType: "branch",
+		Owner:   "owner",
+		Repo:    "api",
+	}
+	down := &webhooks.Ref{
+		Timestamp: t0.Add(-60 * time.Second),
+		RepoID:    "git.example.com/owner/docs",
+		HTTPSURL:  "https://git.example.com/owner/docs.git",
+		Rev:       fmt.Sprintf("d%x", time.Now().UnixNano()),
+		RefName:   "main",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "docs",
+	}
+	// the rev of docs#main can't be looked up, but is known from before
+	storeRecent(&Job{ID: NewJobID(), GitRef: down, Status: StatusSucceeded})
+	// once the job loop is running, it's done loading the repo configs
+	checkQueue <- struct{}{}
+	repoConfigsMux.Lock()
+	repoConfigs[up.RepoID] = &RepoConfig{Downstream: []DownstreamConfig{
+		{After: "master", Deploy: "git.example.com/owner/docs#main"},
+	}}
+	repoConfigsMux.Unlock()
+
+	Debounce(up)
+
+	t.Log("wait for the upstream job, and then the downstream job")
+	var j *Job
+	for i := 0; i < 50 && nil == j; i++ {
+		time.Sleep(jobDelay / 5)
+		// (a rerun may deploy the rev of docs#main from the last run's logs)
+		RecentRuns.Range(func(key, value interface{}) bool {
+			job := value.(*Job)
+			if down.RepoID == job.GitRef.RepoID && nil != job.Upstream && up.Rev == job.Upstream.Rev {
+				j = job
+			}
+			return nil == j
+		})
+	}
+	if nil == j {
+		t.Fatalf("should have deployed downstream")
+	}
+	value, _ := Recents.Load(webhooks.New(up).GetRevID())
+	if nil == j.Upstream || up.RepoID != j.Upstream.RepoID || value.(*Job).ID != j.UpstreamID {
+		t.Errorf("should know which job it came after: %#v", j)
+	}
+
+	logged, err := LoadLogs(runOpts, j.ID)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, l := range logged.Logs {
+		if strings.Contains(l.Text, "after git.example.com/owner/api#master") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("should pass the upstream ref as GIT_UPSTREAM_* ENVs")
+	}
+
+	// a promotion of the upstream ref didn't deploy it
+	downstreams := func() int {
+		var n int
+		RecentRuns.Range(func(key, value interface{}) bool {
+			if down.RepoID == value.(*Job).GitRef.RepoID && TriggerUpstream == value.(*Job).Trigger {
+				n++
+			}
+			return true
+		})
+		return n
+	}
+	before := downstreams()
+	Promote(up, "production")
+	time.Sleep(jobDelay / 5)
+	for i := 0; i < 50; i++ {
+		if _, ok := Actives.Load(webhooks.New(up).GetRefID()); !ok {
+			break
+		}
+		time.Sleep(jobDelay / 5)
+	}
+	// long enough for a downstream job to debounce and run
+	time.Sleep(2 * jobDelay)
+	if n := downstreams(); before != n {
+		t.Errorf("a promotion should not deploy downstream, but %d more did", n-before)
+	}
+}
+
+func TestManualDeploy(t *testing.T) {
+	opts := *runOpts
+	opts.RepoList = "git.example.com/owner/exact git.example.com/Trusted-*"
+	for repoID, known := range map[string]bool{
+		"git.example.com/owner/exact":     true,
+		"git.example.com/trusted-x/repo":  true,
+		"git.example.com/owner/exactly":   false,
+		"git.example.com/untrusted/repo":  false,
+		"git.example.com/owner/not-exact": false,
+	} {
+		if known != isKnownRepo(&opts, repoID) {
+			t.Errorf("%s should be known: %t", repoID, known)
+		}
+	}
+
+	// once the job loop is running, it's done loading the repo configs
+	checkQueue <- struct{}{}
+	repoID := "git.example.com/owner/manual"
+	repoConfigsMux.Lock()
+	// long enough to push before the manual deploy runs
+	repoConfigs[repoID] = &RepoConfig{Debounce: &DebounceConfig{Delay: Duration(5 * time.Second)}}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		delete(repoConfigs, repoID)
+		repoConfigsMux.Unlock()
+	}()
+	push := func(refName string) *webhooks.Ref {
+		return webhooks.New(webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    repoID,
+			HTTPSURL:  "https://" + repoID + ".git",
+			// unique to this run, since old logs are read back into Recents
+			Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+			RefName: refName,
+			RefType: "branch",
+			Owner:   "owner",
+			Repo:    "manual",
+		})
+	}
+	pending := func(refID webhooks.RefID) *Job {
+		// the job loop has handled what was sent before this
+		checkQueue <- struct{}{}
+		if value, ok := Pending.Load(refID); ok {
+			return value.(*Job)
+		}
+		return nil
+	}
+
+	manual := Deploy(push("main"), "tester", map[string]string{"TARGET": "www2"}, false)
+	pushed := push("main")
+	Debounce(*pushed)
+	j := pending(pushed.GetRefID())
+	if nil == j || manual.ID != j.ID || TriggerManual != j.Trigger || "tester" != j.TriggeredBy ||
+		"www2" != j.Inputs["TARGET"] || pushed.Rev != j.GitRef.Rev {
+		t.Errorf("a push should keep the manual deploy %s, with the pushed rev %s: %#v", manual.ID, pushed.Rev, j)
+	}
+	Cancel(runOpts, pushed.GetRefID())
+
+	rolledBack := push("dev")
+	rollback := Rollback(&Job{ID: NewJobID(), GitRef: rolledBack}, "tester", false)
+	pushed = push("dev")
+	Debounce(*pushed)
+	j = pending(pushed.GetRefID())
+	if nil == j || rollback.ID != j.ID || rolledBack.Rev != j.GitRef.Rev ||
+		nil == j.NextPush || pushed.Rev != j.NextPush.Rev {
+		t.Fatalf("a push should wait behind the rollback %s to %s: %#v", rollback.ID, rolledBack.Rev, j)
+	}
+	// once the rollback starts, the push is next
+	Bump(pushed.GetRefID())
+	j = pending(pushed.GetRefID())
+	if value, ok := Actives.Load(pushed.GetRefID()); !ok || rollback.ID != value.(*Job).ID {
+		t.Errorf("the rollback %s should have started", rollback.ID)
+	}
+	if nil == j || TriggerWebhook != j.Trigger || pushed.Rev != j.GitRef.Rev {
+		t.Errorf("the push of %s should be queued after the rollback: %#v", pushed.Rev, j)
+	}
+	Cancel(runOpts, pushed.GetRefID())
+}
+
+func TestSchedules(t *testing.T) {
+	// a Monday
+	now := time.Date(2021, 3, 1, 10, 17, 30, 0, time.UTC)
+	nexts := map[string]time.Time{
+		"*/15 * * * *":          time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC),
+		"0 3 * * *":             time.Date(2021, 3, 2, 3, 0, 0, 0, time.UTC),
+		"@weekly":               time.Date(2021, 3, 7, 0, 0, 0, 0, time.UTC),
+		"0 12 * * 7":            time.Date(2021, 3, 7, 12, 0, 0, 0, time.UTC),
+		"0 9-17/4 * * *":        time.Date(2021, 3, 1, 13, 0, 0, 0, time.UTC),
+		"30 9 1,15 * mon-fri":   time.Date(2021, 3, 2, 9, 30, 0, 0, time.UTC),
+		"0 0 15 apr,jun *":      time.Date(2021, 4, 15, 0, 0, 0, 0, time.UTC),
+		"0 0 29 feb *":          time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 1 * sat":           time.Date(2021, 3, 6, 0, 0, 0, 0, time.UTC),
+		"17 10 1 3 *":           time.Date(2022, 3, 1, 10, 17, 0, 0, time.UTC),
+		"  @Daily ":             time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC),
+		"18,19 10 * * *":        time.Date(2021, 3, 1, 10, 18, 0, 0, time.UTC),
+		"0 0 * * *  # nightly ": {},
+	}
+	for expr, expected := range nexts {
+		spec, err := parseCron(expr)
+		if expected.IsZero() {
+			if nil == err {
+				t.Errorf("%q should not parse", expr)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("%q: %v", expr, err)
+			continue
+		}
+		if next := spec.next(now); !expected.Equal(next) {
+			t.Errorf("%q should next come at %s, not %s", expr, expected, next)
+		}
+	}
+
+	for _, sched := range []ScheduleConfig{
+		{Cron: "* * *", Ref: "main"},
+		{Cron: "60 * * * *", Ref: "main"},
+		{Cron: "5-1 * * * *", Ref: "main"},
+		{Cron: "*/0 * * * *", Ref: "main"},
+		{Cron: "0 0 31 feb *", Ref: "main"},
+		{Cron: "@daily"},
+		{Cron: "@daily", Ref: "v1", RefType: "release"},
+	} {
+		if err := validateSchedules([]ScheduleConfig{sched}); nil == err {
+			t.Errorf("%#v should not be valid", sched)
+		}
+	}
+
+	site := &webhooks.Ref{
+		Timestamp: t0.Add(-60 * time.Second),
+		RepoID:    "git.example.com/owner/site",
+		HTTPSURL:  "https://git.example.com/owner/site.git",
+		Rev:       "0123456789",
+		RefName:   "main",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "site",
+	}
+	// the rev of site#main can't be looked up, but is known from before
+	storeRecent(&Job{ID: NewJobID(), GitRef: site, Status: StatusSucceeded})
+
+	deploySchedule(runOpts, site.RepoID, &ScheduleConfig{Cron: "@daily", Ref: "main"})
+
+	var j *Job
+	for i := 0; i < 50 && nil == j; i++ {
+		time.Sleep(jobDelay / 5)
+		if value, ok := Recents.Load(site.GetRevID()); ok && TriggerSchedule == value.(*Job).Trigger {
+			j = value.(*Job)
+		}
+	}
+	if nil == j {
+		t.Fatalf("should have deployed on schedule")
+	}
+	if "@daily" != j.TriggeredBy || StatusSucceeded != j.Status {
+		t.Errorf("should have deployed the rev that was known: %#v", j)
+	}
+}
+
+func TestFreezes(t *testing.T) {
+	start := time.Date(2021, 11, 26, 0, 0, 0, 0, time.UTC)
+	for _, win := range []FreezeWindow{
+		{Reason: "neither"},
+		{Start: start, Reason: "no end"},
+		{Start: start, End: start.Add(-time.Hour), Reason: "backwards"},
+		{Cron: "0 17 * * fri", Reason: "no duration"},
+		{Cron: "0 17 * * fri", Duration: Duration(time.Hour), Start: start, End: start.Add(time.Hour), Reason: "both"},
+		{Start: start, End: start.Add(time.Hour), Refs: []string{"[main"}, Reason: "bad pattern"},
+	} {
+		if err := validateFreezes([]FreezeWindow{win}); nil == err {
+			t.Errorf("freeze %q should not be valid", win.Reason)
+		}
+	}
+
+	windows := []FreezeWindow{
+		{Start: start, End: start.Add(4 * 24 * time.Hour), Refs: []string{"main", "v*"}, Reason: "Black Friday"},
+		{Cron: "0 17 * * fri", Duration: Duration(63 * time.Hour), Reason: "weekend"},
+	}
+	if err := validateFreezes(windows); nil != err {
+		t.Fatal(err)
+	}
+	// a Saturday
+	sat := time.Date(2021, 3, 6, 10, 0, 0, 0, time.UTC)
+	if until := windows[1].until("main", sat); !time.Date(2021, 3, 8, 8, 0, 0, 0, time.UTC).Equal(until) {
+		t.Errorf("the weekend freeze should end on Monday at 8, not %s", until)
+	}
+	if until := windows[1].until("main", sat.Add(46*time.Hour)); !until.IsZero() {
+		t.Errorf("the weekend freeze should be over on Monday at 8, not %s", until)
+	}
+	if until := windows[0].until("v1.0.0", start.Add(time.Hour)); !start.Add(4 * 24 * time.Hour).Equal(until) {
+		t.Errorf("tags should be frozen until Tuesday, not %s", until)
+	}
+	if until := windows[0].until("dev", start.Add(time.Hour)); !until.IsZero() {
+		t.Errorf("only main and tags should be frozen")
+	}
+
+	hook := webhooks.Ref{
+		Timestamp: time.Now(),
+		RepoID:    "git.example.com/owner/shop",
+		HTTPSURL:  "https://git.example.com/owner/shop.git",
+		Rev:       "abc123def0",
+		RefName:   "main",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "shop",
+	}
+	// once the job loop is running, it's done loading the freezes
+	checkQueue <- struct{}{}
+	repoConfigsMux.Lock()
+	freezes = []FreezeWindow{{Start: time.Now().Add(-time.Minute), End: time.Now().Add(4 * jobDelay), Reason: "Black Friday"}}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		freezes = nil
+		repoConfigsMux.Unlock()
+	}()
+
+	waitFor := func(hook webhooks.Ref, reason string) {
+		for i := 0; i < 20; i++ {
+			time.Sleep(jobDelay / 5)
+			for _, j := range All(time.Time{}) {
+				if j.GitRef.Rev == hook.Rev && StatusPending == j.Status && strings.Contains(j.WaitReason, reason) {
+					return
+				}
+			}
+		}
+		t.Fatalf("%s should be held with %q", hook.GetRevID(), reason)
+	}
+	deployed := func(hook webhooks.Ref) bool {
+		for i := 0; i < 50; i++ {
+			time.Sleep(jobDelay / 5)
+			if value, ok := Recents.Load(webhooks.New(hook).GetRevID()); ok && StatusSucceeded == value.(*Job).Status {
+				return true
+			}
+		}
+		return false
+	}
+
+	Debounce(hook)
+	waitFor(hook, "frozen until")
+	waitFor(hook, ": Black Friday")
+	if !deployed(hook) {
+		t.Fatalf("should have deployed once the freeze ended")
+	}
+
+	if _, err := Pause(runOpts, hook.RepoID, "jane", "migrating servers"); nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := loadPauses(runOpts)[hook.RepoID]; !ok {
+		t.Errorf("the pause should be saved for the next start")
+	}
+	hook.Rev = "def456abc0"
+	hook.Timestamp = time.Now()
+	Debounce(hook)
+	waitFor(hook, "git.example.com/owner/shop is paused by jane: migrating servers")
+	if err := Resume(runOpts, hook.RepoID); nil != err {
+		t.Fatal(err)
+	}
+	if err := Resume(runOpts, hook.RepoID); ErrNotPaused != err {
+		t.Errorf("should not resume twice: %v", err)
+	}
+	if !deployed(hook) {
+		t.Fatalf("should have deployed once resumed")
+	}
+	if 0 != len(loadPauses(runOpts)) {
+		t.Errorf("the resume should be saved for the next start")
+	}
+}
+
+func TestQueue(t *testing.T) {
+	repoID := "git.example.com/owner/queue"
+	if _, err := Pause(runOpts, repoID, "", "testing the queue"); nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = Resume(runOpts, repoID)
+	}()
+
+	hooks := []*webhooks.Ref{}
+	for _, refName := range []string{"one", "two", "three"} {
+		hook := webhooks.New(webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    repoID,
+			HTTPSURL:  "https://" + repoID + ".git",
+			Rev:       "0000000000" + refName,
+			RefName:   refName,
+			RefType:   "branch",
+			Owner:     "owner",
+			Repo:      "queue",
+		})
+		hooks = append(hooks, hook)
+		Debounce(*hook)
+	}
+	// still settling, long after the others are queued
+	slowOpts := *runOpts
+	slowOpts.DebounceDelay = time.Minute
+	slow := webhooks.New(webhooks.Ref{
+		Timestamp: time.Now(),
+		RepoID:    repoID,
+		HTTPSURL:  "https://" + repoID + ".git",
+		Rev:       "0000000000four",
+		RefName:   "four",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "queue",
+	})
+	saveBacklog(&Job{GitRef: slow, Trigger: TriggerWebhook}, runOpts)
+	debounce(slow, &slowOpts)
+
+	var queued []*Job
+	for i := 0; i < 20; i++ {
+		time.Sleep(jobDelay / 5)
+		queued = Queue()
+		if 4 == len(queued) && 3 == queued[2].QueuePosition {
+			break
+		}
+	}
+	if 4 != len(queued) {
+		t.Fatalf("should have queued 4 jobs, not %d", len(queued))
+	}
+	for i, j := range queued[:3] {
+		if i+1 != j.QueuePosition || !strings.Contains(j.WaitReason, "testing the queue") {
+			t.Errorf("should be held in line: %d %q", j.QueuePosition, j.WaitReason)
+		}
+	}
+	last := queued[3]
+	if slow.Rev != last.GitRef.Rev || 0 != last.QueuePosition || nil == last.DebounceUntil {
+		t.Fatalf("should still be debouncing: %#v", last)
+	}
+	if last.DebounceUntil.Before(time.Now().Add(50 * time.Second)) {
+		t.Errorf("should debounce for about a minute, not until %s", last.DebounceUntil)
+	}
+
+	if !Bump(slow.GetRefID()) {
+		t.Fatalf("should bump the debouncing job")
+	}
+	queued = Queue()
+	if slow.Rev != queued[0].GitRef.Rev || 1 != queued[0].QueuePosition || nil != queued[0].DebounceUntil {
+		t.Errorf("should be first in line, no longer debouncing: %#v", queued[0])
+	}
+
+	second := queued[2]
+	refID, ok := FindPending(second.ID)
+	if !ok || !Cancel(runOpts, refID) {
+		t.Fatalf("should cancel the pending job %s", second.ID)
+	}
+	if Cancel(runOpts, refID) {
+		t.Errorf("should not cancel twice")
+	}
+	repoDir, repoFile, _ := getBacklogFilePath(runOpts.BacklogDir, second.GitRef)
+	if _, err := os.Stat(filepath.Join(repoDir, repoFile)); !os.IsNotExist(err) {
+		t.Errorf("should have removed the backlog file: %v", err)
+	}
+	queued = Queue()
+	if 3 != len(queued) {
+		t.Fatalf("should have 3 jobs left, not %d", len(queued))
+	}
+	for i, j := range queued {
+		if i+1 != j.QueuePosition || second.ID == j.ID {
+			t.Errorf("should have moved up the rest of the queue: %d %s", j.QueuePosition, j.ID)
+		}
+	}
+
+	if n := Flush(runOpts); 3 != n {
+		t.Errorf("should have flushed the 3 that were left, not %d", n)
+	}
+	if err := Resume(runOpts, repoID); nil != err {
+		t.Fatal(err)
+	}
+	time.Sleep(jobDelay)
+	for _, hook := range append(hooks, slow) {
+		if _, ok := Recents.Load(hook.GetRevID()); ok {
+			t.Errorf("%s should not have run after being canceled", hook.GetRevID())
+		}
+	}
+}
+
+func TestLoadRepoConfigs(t *testing.T) {
+	scriptsDir, _ := ioutil.TempDir("", "gitdeploy-scripts-*")
+	defer os.RemoveAll(scriptsDir)
+	opts := *runOpts
+	opts.ScriptsPath = scriptsDir
+	writeConfig := func(repoID, config string) {
+		repoDir := filepath.Join(scriptsDir, filepath.FromSlash(repoID))
+		_ = os.MkdirAll(repoDir, 0755)
+		_ = ioutil.WriteFile(filepath.Join(repoDir, "config.json"), []byte(config), 0644)
+	}
+
+	writeConfig("git.example.com/owner/good", `{ "locks": ["www-root"] }`)
+	configs, err := LoadRepoConfigs(&opts)
+	if nil != err || 1 != len(configs) || "www-root" != configs["git.example.com/owner/good"].Locks[0] {
+		t.Fatalf("should load the config: %#v %v", configs, err)
+	}
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{
+		{`{ "locks": [`, "could not parse"},
+		{`{ "inputs": [{ "name": "not-a-name" }] }`, "invalid"},
+		{`{ "downstream": [{ "after": "main", "deploy": "git.example.com/owner/good#main" }] }`, "downstream triggers loop"},
+	} {
+		writeConfig("git.example.com/owner/bad", c.config)
+		writeConfig("git.example.com/owner/good",
+			`{ "downstream": [{ "after": "main", "deploy": "git.example.com/owner/bad#main" }] }`)
+		if _, err := LoadRepoConfigs(&opts); nil == err || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s should fail with %q, not %v", c.config, c.err, err)
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	// the job loop has loaded its configs, and won't replace these
+	checkQueue <- struct{}{}
+	repoIDs := []string{"git.example.com/owner/site", "git.example.com/owner/blog"}
+	repoConfigsMux.Lock()
+	for _, repoID := range repoIDs {
+		repoConfigs[repoID] = &RepoConfig{Locks: []string{"www-root"}}
+	}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		for _, repoID := range repoIDs {
+			delete(repoConfigs, repoID)
+		}
+		repoConfigsMux.Unlock()
+	}()
+
+	refIDs := map[string]webhooks.RefID{}
+	revIDs := []webhooks.RevID{}
+	for _, repoID := range repoIDs {
+		hook := webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    repoID,
+			HTTPSURL:  "https://" + repoID + ".git",
+			// unique to this run, since old logs are read back into Recents
+			Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+			RefName: "main",
+			RefType: "branch",
+			Owner:   "owner",
+			Repo:    path.Base(repoID),
+		}
+		refIDs[repoID] = webhooks.New(hook).GetRefID()
+		revIDs = append(revIDs, webhooks.New(hook).GetRevID())
+		Debounce(hook)
+	}
+
+	// whichever starts first holds the lock, and the other waits on it
+	var waited bool
+	for i := 0; i < 100 && !waited; i++ {
+		time.Sleep(jobDelay / 25)
+		for _, j := range Queue() {
+			// (one may still be debouncing)
+			if "" == j.WaitReason || j.GitRef.RepoID != repoIDs[0] && j.GitRef.RepoID != repoIDs[1] {
+				continue
+			}
+			for _, repoID := range repoIDs {
+				value, ok := Actives.Load(refIDs[repoID])
+				if !ok || repoID == j.GitRef.RepoID {
+					continue
+				}
+				holder := value.(*Job)
+				expected := fmt.Sprintf("waiting for lock %q held by job %s (%s)",
+					"www-root", holder.ID, holder.GitRef.GetRefID())
+				if expected != j.WaitReason {
+					t.Errorf("should be %q, not %q", expected, j.WaitReason)
+				}
+				waited = true
+			}
+		}
+	}
+	if !waited {
+		t.Errorf("one job should have waited on the other's lock")
+	}
+
+	jobs := []*Job{}
+	for i := 0; i < 50 && len(jobs) < len(revIDs); i++ {
+		time.Sleep(jobDelay / 5)
+		jobs = []*Job{}
+		for _, revID := range revIDs {
+			if value, ok := Recents.Load(revID); ok && nil != value.(*Job).EndedAt {
+				jobs = append(jobs, value.(*Job))
+			}
+		}
+	}
+	if len(revIDs) != len(jobs) {
+		t.Fatalf("both jobs should have run, not %d", len(jobs))
+	}
+	a, b := jobs[0], jobs[1]
+	if a.StartedAt.Before(*b.EndedAt) && b.StartedAt.Before(*a.EndedAt) {
+		t.Errorf("jobs that share a lock should not overlap: %s-%s and %s-%s",
+			a.StartedAt, a.EndedAt, b.StartedAt, b.EndedAt)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	newHook := func(repoID, refName string) *webhooks.Ref {
+		return webhooks.New(webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    repoID,
+			HTTPSURL:  "https://" + repoID + ".git",
+			Rev:       fmt.Sprintf("%x", time.Now().UnixNano()),
+			RefName:   refName,
+			RefType:   "branch",
+			Owner:     path.Base(path.Dir(repoID)),
+			Repo:      path.Base(repoID),
+		})
+	}
+	// stand-ins for running jobs, each with a process of its own
+	running := []*webhooks.Ref{
+		newHook("git.example.com/busy/one", "a"),
+		newHook("git.example.com/busy/one", "b"),
+		newHook("git.example.com/busy/two", "a"),
+	}
+	for _, hook := range running {
+		Actives.Store(hook.GetRefID(), &Job{ID: NewJobID(), GitRef: hook, cmd: &exec.Cmd{}})
+	}
+	// a promotion is stored under both of its refs, but is only one process
+	promoted := newHook("git.example.com/busy/two", "dev")
+	promotedTo := *promoted
+	promotedTo.RefName = "prod"
+	promotion := &Job{ID: NewJobID(), GitRef: promoted, Promote: true, cmd: &exec.Cmd{}}
+	Actives.Store(promoted.GetRefID(), promotion)
+	Actives.Store(promotedTo.GetRefID(), promotion)
+	defer func() {
+		for _, hook := range append(running, promoted, &promotedTo) {
+			Actives.Delete(hook.GetRefID())
+		}
+	}()
+
+	opts := *runOpts
+	for _, c := range []struct {
+		maxJobs, perRepo, perOwner int
+		hook                       *webhooks.Ref
+		reason                     string
+	}{
+		{5, 0, 0, newHook("git.example.com/idle/one", "main"), ""},
+		{4, 0, 0, newHook("git.example.com/idle/one", "main"), "waiting on a free worker (4 of 4 in use)"},
+		{0, 2, 0, newHook("git.example.com/busy/one", "c"), "waiting on a free worker for git.example.com/busy/one (2 of 2 in use)"},
+		{0, 3, 0, newHook("git.example.com/busy/one", "c"), ""},
+		{0, 0, 4, newHook("git.example.com/busy/three", "main"), "waiting on a free worker for git.example.com/busy (4 of 4 in use)"},
+		{0, 0, 4, newHook("git.example.com/idle/one", "main"), ""},
+	} {
+		opts.MaxJobs, opts.MaxJobsPerRepo, opts.MaxJobsPerOwner = c.maxJobs, c.perRepo, c.perOwner
+		if reason := waitReason(c.hook, &opts); c.reason != reason {
+			t.Errorf("%s with limits %d/%d/%d should wait with %q, not %q",
+				c.hook.GetRefID(), c.maxJobs, c.perRepo, c.perOwner, c.reason, reason)
+		}
+	}
+
+	// the job loop waits on the same lock, so it can't start them out from under the test
+	checkQueue <- struct{}{}
+	queued := "git.example.com/locked/queue"
+	promoting := "git.example.com/locked/promoted"
+	repoConfigsMux.Lock()
+	repoConfigs[queued] = &RepoConfig{Locks: []string{"db"}}
+	repoConfigs[promoting] = &RepoConfig{Locks: []string{"db"}}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		delete(repoConfigs, queued)
+		delete(repoConfigs, promoting)
+		repoConfigsMux.Unlock()
+	}()
+	holder := &Job{ID: NewJobID(), GitRef: newHook("git.example.com/locked/holder", "main"), Locks: []string{"db"}, cmd: &exec.Cmd{}}
+	Actives.Store(holder.GitRef.GetRefID(), holder)
+	defer Actives.Delete(holder.GitRef.GetRefID())
+
+	// a promotion waits on the lock too
+	toPromote := newHook(promoting, "dev")
+	Promote(*toPromote, "prod")
+	if _, ok := Actives.Load(toPromote.GetRefID()); ok {
+		t.Errorf("the promotion should wait for the lock")
+	}
+
+	q1, q2 := newHook(queued, "one"), newHook(queued, "two")
+	jobsTimersMux.Lock()
+	for _, hook := range []*webhooks.Ref{q1, q2} {
+		Pending.Store(hook.GetRefID(), &Job{ID: NewJobID(), GitRef: hook})
+		enqueue(hook.GetRefID(), "testing limits")
+	}
+	jobsTimersMux.Unlock()
+	runQueued(runOpts)
+
+	positions := func() map[webhooks.RefID]*Job {
+		m := map[webhooks.RefID]*Job{}
+		for _, j := range Queue() {
+			if queued == j.GitRef.RepoID {
+				m[j.GitRef.GetRefID()] = j
+			}
+		}
+		return m
+	}
+	waiting := positions()
+	for i, hook := range []*webhooks.Ref{q1, q2} {
+		j := waiting[hook.GetRefID()]
+		if nil == j || i+1 != j.QueuePosition || !strings.Contains(j.WaitReason, "held by job "+holder.ID) {
+			t.Fatalf("%s should be #%d, waiting on the lock: %#v", hook.GetRefID(), i+1, j)
+		}
+	}
+
+	Actives.Delete(holder.GitRef.GetRefID())
+	runQueued(runOpts)
+	value, ok := Actives.Load(q1.GetRefID())
+	if !ok {
+		t.Fatalf("%s should have started once the lock was free", q1.GetRefID())
+	}
+	waiting = positions()
+	if j := waiting[q2.GetRefID()]; nil == j || 1 != j.QueuePosition || !strings.Contains(j.WaitReason, "held by job "+value.(*Job).ID) {
+		t.Errorf("%s should be next, waiting on the lock: %#v", q2.GetRefID(), j)
+	}
+	Cancel(runOpts, q2.GetRefID())
+
+	// and runs once the queued job is done with the lock
+	var promotedOnce bool
+	for i := 0; i < 50 && !promotedOnce; i++ {
+		time.Sleep(jobDelay / 5)
+		RecentRuns.Range(func(key, value interface{}) bool {
+			j := value.(*Job)
+			if j.Promote && promoting == j.GitRef.RepoID && StatusSucceeded == j.Status {
+				promotedOnce = true
+			}
+			return !promotedOnce
+		})
+	}
+	if !promotedOnce {
+		t.Errorf("the promotion should have run once the lock was free")
+	}
+}
+
+func TestPriorities(t *testing.T) {
+	for _, rules := range [][]PriorityRule{
+		{{Class: "urgent"}},
+		{{Class: PriorityHigh, Refs: []string{"[main"}}},
+	} {
+		if err := validatePriorities(rules); nil == err {
+			t.Errorf("%#v should not be valid", rules)
+		}
+	}
+	conf := &RepoConfig{Priorities: []PriorityRule{{Class: PriorityHigh, Repos: []string{"*"}}}}
+	if err := conf.validate(); nil == err {
+		t.Errorf("a repo's own priorities should not name repos")
+	}
+
+	noisy := "git.example.com/owner/noisy"
+	quiet := "git.example.com/owner/quiet"
+	// once the job loop is running, it's done loading the priorities
+	checkQueue <- struct{}{}
+	for _, repoID := range []string{noisy, quiet} {
+		// so that the queue holds still
+		if _, err := Pause(runOpts, repoID, "", "testing priorities"); nil != err {
+			t.Fatal(err)
+		}
+	}
+	repoConfigsMux.Lock()
+	priorities = []PriorityRule{
+		{Class: PriorityHigh, Triggers: []string{TriggerManual, TriggerRollback}},
+		{Class: PriorityLow, Repos: []string{"git.example.com/owner/*"}, Refs: []string{"preview-*"}},
+	}
+	repoConfigs[quiet] = &RepoConfig{Priorities: []PriorityRule{{Class: PriorityLow, Refs: []string{"docs"}}}}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		priorities = nil
+		delete(repoConfigs, quiet)
+		repoConfigsMux.Unlock()
+		Flush(runOpts)
+		_ = Resume(runOpts, noisy)
+		_ = Resume(runOpts, quiet)
+	}()
+
+	// in the order they arrive
+	arrivals := []struct {
+		repoID  string
+		refName string
+		trigger string
+	}{
+		{noisy, "preview-1", ""},
+		{noisy, "one", ""},
+		{noisy, "two", ""},
+		{noisy, "three", ""},
+		{quiet, "docs", ""},
+		{quiet, "main", ""},
+		{noisy, "hotfix", TriggerManual},
+	}
+	jobsTimersMux.Lock()
+	for _, a := range arrivals {
+		job := &Job{
+			ID: NewJobID(),
+			GitRef: webhooks.New(webhooks.Ref{
+				Timestamp: time.Now(),
+				RepoID:    a.repoID,
+				HTTPSURL:  "https://" + a.repoID + ".git",
+				Rev:       "0000000000",
+				RefName:   a.refName,
+				RefType:   "branch",
+				Owner:     "owner",
+				Repo:      path.Base(a.repoID),
+			}),
+			Trigger: a.trigger,
+		}
+		Pending.Store(job.GitRef.GetRefID(), job)
+		enqueue(job.GitRef.GetRefID(), "testing priorities")
+	}
+	jobsTimersMux.Unlock()
+
+	expected := []string{
+		"noisy#hotfix high",
+		"noisy#one normal",
+		"quiet#main normal",
+		"noisy#two normal",
+		"noisy#three normal",
+		"noisy#preview-1 low",
+		"quiet#docs low",
+	}
+	queued := Queue()
+	if len(expected) != len(queued) {
+		t.Fatalf("should have queued %d jobs, not %d", len(expected), len(queued))
+	}
+	for i, j := range queued {
+		got := path.Base(j.GitRef.RepoID) + "#" + j.GitRef.RefName + " " + j.Priority
+		if expected[i] != got || i+1 != j.QueuePosition {
+			t.Errorf("#%d should be %q, not %q (%d)", i+1, expected[i], got, j.QueuePosition)
+		}
+	}
+
+	// with room to grow, a repo's own rules must not be appended to in place
+	own := make([]PriorityRule, 1, 4)
+	own[0] = PriorityRule{Class: PriorityLow, Refs: []string{"docs"}}
+	repoConfigsMux.Lock()
+	repoConfigs[quiet] = &RepoConfig{Priorities: own}
+	repoConfigsMux.Unlock()
+	_ = priorityClass(&Job{GitRef: &webhooks.Ref{RepoID: quiet, RefName: "main"}})
+	if "" != own[:2][1].Class {
+		t.Errorf("should not have written into the repo config's rules: %#v", own[:2])
+	}
+}
+
+func TestDebounceModes(t *testing.T) {
+	bursty := "git.example.com/owner/bursty"
+	// once the job loop is running, it's done loading the configs
+	checkQueue <- struct{}{}
+	repoConfigsMux.Lock()
+	repoConfigs[bursty] = &RepoConfig{Debounce: &DebounceConfig{
+		Delay:       Duration(time.Minute),
+		MaxWait:     Duration(90 * time.Second),
+		Leading:     true,
+		MinInterval: Duration(time.Minute),
+	}}
+	repoConfigsMux.Unlock()
+	defer func() {
+		repoConfigsMux.Lock()
+		delete(repoConfigs, bursty)
+		repoConfigsMux.Unlock()
+	}()
+
+	newHook := func(refName string) *webhooks.Ref {
+		return webhooks.New(webhooks.Ref{
+			Timestamp: time.Now(),
+			RepoID:    bursty,
+			HTTPSURL:  "https://" + bursty + ".git",
+			Rev:       "0000000000",
+			RefName:   refName,
+			RefType:   "branch",
+			Owner:     "owner",
+			Repo:      "bursty",
+		})
+	}
+	leading := newHook("leading")
+	throttled := newHook("throttled")
+	ended := time.Now().Add(-10 * time.Second)
+	deployed := &Job{ID: NewJobID(), GitRef: throttled, Status: StatusSucceeded, EndedAt: &ended}
+	RecentRuns.Store(deployed.ID, deployed)
+
+	jobsTimersMux.Lock()
+	defer func() {
+		for _, hook := range []*webhooks.Ref{leading, throttled} {
+			stopDebounce(hook.GetRefID())
+			delete(lastPushes, hook.GetRefID())
+		}
+		jobsTimersMux.Unlock()
+		RecentRuns.Delete(deployed.ID)
+	}()
+
+	now := time.Now()
+	if wait := debounceWait(leading, runOpts, now); 0 != wait {
+		t.Errorf("the first push should run right away, not in %s", wait)
+	}
+	// as if it were still debouncing
+	debounceTimers[leading.GetRefID()] = time.NewTimer(time.Hour)
+	if wait := debounceWait(leading, runOpts, now.Add(10*time.Second)); time.Minute != wait {
+		t.Errorf("the next push should wait the delay, not %s", wait)
+	}
+	if wait := debounceWait(leading, runOpts, now.Add(50*time.Second)); 40*time.Second != wait {
+		t.Errorf("a push should wait no longer than the max wait, not %s", wait)
+	}
+	if wait := debounceWait(leading, runOpts, now.Add(2*time.Minute)); 0 != wait {
+		t.Errorf("a push past the max wait should run right away, not %s", wait)
+	}
+	// the first push would run right away, but for the last deploy
+	if wait := debounceWait(throttled, runOpts, ended.Add(10*time.Second)); 50*time.Second != wait {
+		t.Errorf("should wait out the min interval, not %s", wait)
+	}
+}
+
+func TestStaleWebhooks(t *testing.T) {
+	chain := &revLinks{befores: map[string]string{}}
+	chain.link("bbb", "aaa")
+	chain.link("ccc", "bbb")
+	// a force push back to aaa
+	chain.link("aaa", "ccc")
+	if !chain.isAncestor("aaa", "ccc") || !chain.isAncestor("bbb", "ccc") {
+		t.Errorf("aaa and bbb came before ccc")
+	}
+	if chain.isAncestor("ddd", "ccc") {
+		t.Errorf("ddd was never pushed")
+	}
+
+	hook := webhooks.Ref{
+		Timestamp: time.Now(),
+		RepoID:    "git.example.com/owner/late",
+		HTTPSURL:  "https://git.example.com/owner/late.git",
+		RefName:   "main",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "late",
+	}
+	push := func(rev, before string) webhooks.Ref {
+		h := hook
+		h.Rev = rev
+		h.Before = before
+		return h
+	}
+	// unique to this run, since old logs are read back into Recents
+	revs := []string{"0000000000"}
+	for i := 1; i <= 3; i++ {
+		revs = append(revs, fmt.Sprintf("%d%x", i, time.Now().UnixNano()))
+	}
+	// the second push is delivered first
+	Debounce(push(revs[2], revs[1]))
+	Debounce(push(revs[1], revs[0]))
+	deployed := func(rev string) bool {
+		value, ok := Recents.Load(webhooks.New(push(rev, "")).GetRevID())
+		return ok && StatusSucceeded == value.(*Job).Status
+	}
+	for i := 0; i < 50 && !deployed(revs[2]); i++ {
+		time.Sleep(jobDelay / 5)
+	}
+	if !deployed(revs[2]) {
+		t.Fatalf("the second push should have deployed")
+	}
+	if _, ok := Recents.Load(webhooks.New(push(revs[1], "")).GetRevID()); ok {
+		t.Errorf("the late first push should have been ignored")
+	}
+
+	if reason := staleReason(webhooks.New(push(revs[1], revs[0]))); !strings.Contains(reason, "deployed") {
+		t.Errorf("the first push should be older than the deployed rev, not %q", reason)
+	}
+	if reason := staleReason(webhooks.New(push(revs[3], revs[2]))); "" != reason {
+		t.Errorf("a new push should not be stale: %q", reason)
+	}
+	// a force push back to the first rev replaced the deployed one, so it's newer
+	if reason := staleReason(webhooks.New(push(revs[1], revs[2]))); "" != reason {
+		t.Errorf("a force push over the deployed rev should not be stale: %q", reason)
+	}
+
+	// what was deployed before a restart is read back from the logs
+	hook.RefName = "restarted"
+	endedAt := time.Now()
+	earlier := endedAt.Add(-time.Minute)
+	oldJob := func(rev, before, status string, endedAt *time.Time) *Job {
+		h := push(rev, before)
+		return &Job{GitRef: webhooks.New(h), Status: status, EndedAt: endedAt}
+	}
+	rememberDeployedJobs([]*Job{
+		oldJob(revs[2], revs[1], StatusSucceeded, &endedAt),
+		oldJob(revs[1], revs[0], StatusSucceeded, &earlier),
+		oldJob(revs[3], revs[2], StatusFailed, &endedAt),
+	})
+	revsMux.Lock()
+	rev := deployedRevs[webhooks.New(push(revs[1], "")).GetRefID()]
+	revsMux.Unlock()
+	if revs[2] != rev {
+		t.Errorf("the newest successful deploy was %s, not %s", revs[2], rev)
+	}
+	if reason := staleReason(webhooks.New(push(revs[1], revs[0]))); !strings.Contains(reason, "deployed") {
+		t.Errorf("a late redelivery after a restart should be stale, not %q", reason)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	hook := webhooks.Ref{
+		Timestamp: time.Now(),
+		RepoID:    "git.example.com/owner/costly",
+		HTTPSURL:  "https://git.example.com/owner/costly.git",
+		// unique to this run, since old logs are read back into Recents
+		Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+		RefName: "main",
+		RefType: "branch",
+		Owner:   "owner",
+		Repo:    "costly",
+	}
+	Debounce(hook)
+	revID := webhooks.New(hook).GetRevID()
+	var job *Job
+	for i := 0; i < 50 && nil == job; i++ {
+		time.Sleep(jobDelay / 5)
+		if value, ok := Recents.Load(revID); ok {
+			job = value.(*Job)
+		}
+	}
+	if nil == job || nil == job.Usage {
+		t.Fatalf("the job should have ended with its usage")
+	}
+	// deploy.sh sleeps for 100ms, and says when it starts and finishes
+	if job.Usage.WallTime < 100 || job.Usage.OutputBytes < int64(len("Started Finished")) {
+		t.Errorf("should have kept the wall time and output: %#v", job.Usage)
+	}
+	if "windows" != runtime.GOOS && 0 == job.Usage.MaxRSS {
+		t.Errorf("should have kept the max RSS: %#v", job.Usage)
+	}
+
+	var found *RepoUsage
+	for _, repo := range UsageByRepo() {
+		if hook.RepoID == repo.RepoID {
+			found = repo
+		}
+	}
+	if nil == found || found.Jobs < 1 || found.WallTime < job.Usage.WallTime {
+		t.Fatalf("should have added up the repo's usage: %#v", found)
+	}
+	if found.AvgWallTime != found.WallTime/int64(found.Jobs) {
+		t.Errorf("should have averaged the wall time: %#v", found)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	hook := webhooks.Ref{
+		Timestamp: time.Now(),
+		RepoID:    "git.example.com/owner/promoted",
+		HTTPSURL:  "https://git.example.com/owner/promoted.git",
+		// unique to this run, since old logs are read back into Recents
+		Rev:     fmt.Sprintf("%x", time.Now().UnixNano()),
+		RefName: "master",
+		RefType: "branch",
+		Owner:   "owner",
+		Repo:    "promoted",
+	}
+	promoting := func() int {
+		var n int
+		Actives.Range(func(key, value interface{}) bool {
+			if hook.RepoID == value.(*Job).GitRef.RepoID {
+				n++
+			}
+			return true
+		})
+		return n
+	}
+
+	Promote(hook, "production")
+	for i := 0; i < 20 && 0 == promoting(); i++ {
+		time.Sleep(jobDelay / 25)
+	}
+	if 0 == promoting() {
+		t.Fatalf("should have started the promotion")
+	}
+	var listed []*Job
+	for _, j := range All(time.Time{}) {
+		// (and not the promotions of earlier runs)
+		if hook.RepoID == j.GitRef.RepoID && nil == j.EndedAt {
+			listed = append(listed, j)
+		}
+	}
+	if 1 != len(listed) || 26 != len(listed[0].ID) {
+		t.Errorf("should list the promotion once, with a job ID of its own: %#v", listed)
+	}
+	for i := 0; i < 50 && 0 != promoting(); i++ {
+		time.Sleep(jobDelay / 5)
+	}
+	// or else the server could never stop
+	if n := promoting(); 0 != n {
+		t.Fatalf("should have removed every active entry of the promotion, not left %d", n)
+	}
+}
+
+// TestStop must run last, as it stops the job loop
+func TestStop(t *testing.T) {
+	t9 := t0.Add(-10 * time.Second)
+	hook := webhooks.Ref{
+		Timestamp: t9,
+		RepoID:    "git.example.com/owner/repo",
+		HTTPSURL:  "https://git.example.com/owner/repo.git",
+		Rev:       "123456789a",
+		RefName:   "stop",
+		RefType:   "branch",
+		Owner:     "owner",
+		Repo:      "repo",
+	}
+	Debounce(hook)
+
+	t.Log("sleep so job can debounce and start")
+	time.Sleep(debounceDelay)
+
+	// ShutdownTimeout is 0, so the job is killed right away
+	Stop()
+
+	value, ok := Recents.Load(hook.GetRevID())
+	if !ok {
+		t.Fatalf("should have written the final record of the stopped job")
+	}
+	if j := value.(*Job); StatusInterrupted != j.Status {
+		t.Errorf("should mark the stopped job as interrupted, not %q", j.Status)
+	}
+}
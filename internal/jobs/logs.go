@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -29,12 +30,24 @@ func WalkLogs(runOpts *options.ServerConfig) ([]*Job, error) {
 			log.Printf("failed to walk log dir: %v", err)
 			return nil
 		}
+		if d.IsDir() && strings.HasSuffix(d.Name(), ".artifacts") {
+			// a job's artifacts are kept (and removed) along with its log
+			if name, ok := parseJobLogName(d.Name()); ok && now.Sub(name.Timestamp) >= runOpts.ExpiredLogAge {
+				log.Printf("[gitdeploy] remove %s", logpath)
+				_ = os.RemoveAll(logpath)
+			}
+			return fs.SkipDir
+		}
 		if !d.Type().IsRegular() || '.' == logpath[0] || '_' == logpath[0] || '~' == logpath[0] {
 			return nil
 		}
 
 		rel := logpath[pathLen:]
 		paths := strings.Split(rel, "/")
+		if len(paths) < 2 {
+			// logs are always in a repo's directory
+			return nil
+		}
 		repoID := strings.Join(paths[:len(paths)-1], "/")
 		repoName := paths[len(paths)-2]
 		var repoOwner string
@@ -44,15 +57,22 @@ func WalkLogs(runOpts *options.ServerConfig) ([]*Job, error) {
 		}
 		logname := paths[len(paths)-1]
 
-		rev := strings.Split(logname, ".")
-		if 4 != len(rev) {
+		name, ok := parseJobLogName(logname)
+		if !ok {
 			return nil
 		}
+		if "" == name.ID && "json" == name.Ext {
+			// from before jobs had IDs and full revs
+			if newpath, ok := migrateJobLog(logpath, logname); ok {
+				logpath = newpath
+				logname = filepath.Base(newpath)
+				name, _ = parseJobLogName(logname)
+			}
+		}
 
-		ts, _ := time.ParseInLocation(options.TimeFile, rev[0], time.UTC)
-		age := now.Sub(ts)
+		age := now.Sub(name.Timestamp)
 		if age <= runOpts.StaleLogAge {
-			if "json" == rev[3] {
+			if "json" == name.Ext {
 				if f, err := os.Open(logpath); nil != err {
 					log.Printf("[warn] failed to read log dir")
 				} else {
@@ -61,13 +81,14 @@ func WalkLogs(runOpts *options.ServerConfig) ([]*Job, error) {
 					if err := dec.Decode(j); nil == err {
 						// don't keep all the logs in memory
 						j.Logs = []Log{}
-						j.ID = string(j.GitRef.GetRevID())
+						setLoggedID(j, name, logname)
 						if nil == j.EndedAt {
 							now := time.Now()
 							j.EndedAt = &now
 						}
 						oldJobs = append(oldJobs, j)
 					}
+					_ = f.Close()
 				}
 			} else {
 				hook := &webhooks.Ref{
@@ -75,16 +96,23 @@ func WalkLogs(runOpts *options.ServerConfig) ([]*Job, error) {
 					RepoID:    repoID,
 					Owner:     repoOwner,
 					Repo:      repoName,
-					Timestamp: ts,
-					RefName:   rev[1],
-					Rev:       rev[2],
+					Timestamp: name.Timestamp,
+					RefName:   name.RefName,
+					Rev:       name.Rev,
 				}
-				now := time.Now()
-				oldJobs = append(oldJobs, &Job{
-					ID:      string(hook.GetRevID()),
+				// a text log without a json log means that
+				// the job never finished (ex: the server crashed)
+				endedAt := time.Now()
+				if info, err := d.Info(); nil == err {
+					endedAt = info.ModTime()
+				}
+				j := &Job{
 					GitRef:  hook,
-					EndedAt: &now,
-				})
+					EndedAt: &endedAt,
+					Status:  StatusInterrupted,
+				}
+				setLoggedID(j, name, logname)
+				oldJobs = append(oldJobs, j)
 			}
 		}
 
@@ -101,45 +129,72 @@ func WalkLogs(runOpts *options.ServerConfig) ([]*Job, error) {
 	return oldJobs, err
 }
 
-//func GetReport(runOpts *options.ServerConfig, safeID webhooks.URLSafeGitID) (*Job, error) {}
-
-// LoadLogs will log logs for a job
-func LoadLogs(runOpts *options.ServerConfig, safeID webhooks.URLSafeGitID) (*Job, error) {
-	b, err := base64.RawURLEncoding.DecodeString(string(safeID))
+// migrateJobLog renames a json log from before jobs had IDs, which has
+// only part of the rev in its name, to have the full rev and an ID
+func migrateJobLog(logpath, logname string) (string, bool) {
+	b, err := ioutil.ReadFile(logpath)
 	if nil != err {
-		return nil, err
+		return "", false
 	}
+	j := &Job{}
+	if err := json.Unmarshal(b, j); nil != err || nil == j.GitRef || "" == j.GitRef.Rev {
+		return "", false
+	}
+	// the same ID that the log was given before it was renamed
+	j.ID = legacyJobID(strings.TrimSuffix(logname, ".json"))
+	newpath := filepath.Join(filepath.Dir(logpath), getJobLogName(j)+".json")
+	if err := os.Rename(logpath, newpath); nil != err {
+		log.Printf("[warn] could not rename %s: %v", logpath, err)
+		return "", false
+	}
+	return newpath, true
+}
 
-	gitID := string(b)
-	refID := webhooks.RefID(gitID)
-	revID := webhooks.RevID(gitID)
+// setLoggedID gives a job read from a log the ID in the log's name
+// or, for logs from before jobs had IDs, one that's made from it
+func setLoggedID(j *Job, name *jobLogName, logname string) {
+	if "" != name.ID {
+		j.ID = name.ID
+		return
+	}
+	j.logName = strings.TrimSuffix(logname, "."+name.Ext)
+	j.ID = legacyJobID(j.logName)
+}
+
+//func GetReport(runOpts *options.ServerConfig, safeID webhooks.URLSafeGitID) (*Job, error) {}
 
-	var f *os.File = nil
-	if value, ok := Actives.Load(refID); ok {
-		j := value.(*Job)
+// LoadLogs will log logs for a job, by its ID or, as before
+// jobs had IDs, by its URL-safe RefID (if active) or RevID
+func LoadLogs(runOpts *options.ServerConfig, id string) (*Job, error) {
+	if j, ok := findActive(id); ok {
 		j.mux.Lock()
 		j.Logs = j.Logs[:]
 		j.mux.Unlock()
 		return j, nil
 	}
 
-	if value, ok := Recents.Load(revID); ok {
-		j := value.(*Job)
-		f, err = openJobFile(runOpts.LogDir, j.GitRef, ".json")
-		if nil != err {
-			return nil, err
-		}
+	var recent *Job
+	if value, ok := RecentRuns.Load(id); ok {
+		recent = value.(*Job)
+	} else if b, err := base64.RawURLEncoding.DecodeString(id); nil == err {
+		recent, _ = findRecent(webhooks.RevID(b))
 	}
-
-	if nil == f {
+	if nil == recent {
 		return nil, errors.New("no job found")
 	}
+
+	f, err := openJobFile(runOpts.LogDir, recent, ".json")
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+
 	dec := json.NewDecoder(f)
 	j := &Job{}
 	if err := dec.Decode(j); nil != err {
 		return nil, errors.New("couldn't read log file")
 	}
-	j.ID = string(gitID)
+	j.ID = recent.ID
 
 	return j, nil
 }
@@ -149,6 +204,7 @@ type Log struct {
 	Timestamp time.Time `json:"timestamp"`
 	Stderr    bool      `json:"stderr"`
 	Text      string    `json:"text"`
+	Stage     string    `json:"stage,omitempty"`
 }
 
 type outWriter struct {
@@ -157,12 +213,16 @@ type outWriter struct {
 }
 
 func (w outWriter) Write(b []byte) (int, error) {
+	now := time.Now()
 	w.job.mux.Lock()
 	w.job.Logs = append(w.job.Logs, Log{
-		Timestamp: time.Now().UTC(),
+		Timestamp: now.UTC(),
 		Stderr:    false,
 		Text:      string(b),
+		Stage:     w.job.stage,
 	})
+	w.job.lastOutput = now
+	w.job.usage.OutputBytes += int64(len(b))
 	w.job.mux.Unlock()
 	return len(b), nil
 }
@@ -173,12 +233,16 @@ type errWriter struct {
 }
 
 func (w errWriter) Write(b []byte) (int, error) {
+	now := time.Now()
 	w.job.mux.Lock()
 	w.job.Logs = append(w.job.Logs, Log{
-		Timestamp: time.Now().UTC(),
+		Timestamp: now.UTC(),
 		Stderr:    true,
 		Text:      string(b),
+		Stage:     w.job.stage,
 	})
+	w.job.lastOutput = now
+	w.job.usage.OutputBytes += int64(len(b))
 	w.job.mux.Unlock()
 	return len(b), nil
 }
@@ -0,0 +1,353 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// PipelineFile is where a trusted repo may describe its own pipeline
+const PipelineFile = ".gitdeploy/pipeline.json"
+
+// StageCheckout is the first stage of a trusted repo's job (with --pipelines),
+// in which gitdeploy clones the repo into GIT_DEPLOY_WORKSPACE to read its pipeline
+const StageCheckout = "checkout"
+
+// ErrUnknownArtifact is for an artifact that the job didn't save
+var ErrUnknownArtifact = errors.New("no such artifact")
+
+// checkoutScript clones the rev into the job's workspace
+// (as deploy.sh would, so that it can use the same checkout)
+const checkoutScript = `set -o errexit
+set -o nounset
+if [[ -z "${GIT_DEPLOY_WORKSPACE}" ]]; then
+    echo "could not create a workspace to check out into" >&2
+    exit 1
+fi
+my_dir="${GIT_DEPLOY_WORKSPACE}/${GIT_REPO_NAME}"
+git clone --quiet --depth=1 --branch "${GIT_REF_NAME}" -- "${GIT_CLONE_URL}" "${my_dir}"
+cd "${my_dir}"
+if [[ -n "${GIT_REV}" ]] && [[ "$(git rev-parse HEAD)" != "${GIT_REV}"* ]]; then
+    git fetch --quiet --depth=1 origin "${GIT_REV}"
+    git checkout --quiet --detach "${GIT_REV}"
+fi
+echo "Checked out ${GIT_REPO_ID}#${GIT_REF_NAME} at $(git rev-parse HEAD)"
+`
+
+// Pipeline is a trusted repo's .gitdeploy/pipeline.json
+type Pipeline struct {
+	// Env is set for every step
+	Env   map[string]string `json:"env,omitempty"`
+	Steps []PipelineStep    `json:"steps"`
+}
+
+// PipelineStep is one stage of a pipeline, run with bash in the checkout
+type PipelineStep struct {
+	Name string `json:"name"`
+	// Run is the bash to run, ex: "npm ci && npm run build"
+	Run string            `json:"run"`
+	Env map[string]string `json:"env,omitempty"`
+	// Timeout kills the step (which fails the job) if it runs longer
+	Timeout Duration `json:"timeout,omitempty"`
+	// Branches and Tags limit the step to the refs that match
+	// (ex: "main" or "release/*"). A step with neither runs for every ref.
+	Branches []string `json:"branches,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Always runs the step even after an earlier step failed
+	Always bool `json:"always,omitempty"`
+	// Artifacts are the files or directories (or patterns of them) in the
+	// checkout to keep once the step succeeds, ex: "dist/*.tar.gz"
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+// parsePipeline reads and validates a pipeline file, with errors
+// that say where the problem is, ex: line 4, column 7: ...
+func parsePipeline(b []byte) (*Pipeline, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	pipeline := &Pipeline{}
+	if err := dec.Decode(pipeline); nil != err {
+		msg := strings.TrimPrefix(err.Error(), "json: ")
+		offset := dec.InputOffset()
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) {
+			// the offset is just past the bad character
+			offset = syntaxErr.Offset - 1
+		} else if errors.As(err, &typeErr) {
+			offset = typeErr.Offset
+		} else if quoted := quotedRe.FindAllString(msg, -1); len(quoted) > 0 {
+			// an unknown field, or a bad duration, is only reported once the
+			// whole file is read, so this finds where it is instead
+			if i := bytes.Index(b, []byte(quoted[len(quoted)-1])); i >= 0 {
+				offset = int64(i)
+			}
+		}
+		line, col := lineCol(b, offset)
+		return nil, fmt.Errorf("line %d, column %d: %s", line, col, msg)
+	}
+	if _, err := dec.Token(); io.EOF != err {
+		line, col := lineCol(b, dec.InputOffset())
+		return nil, fmt.Errorf("line %d, column %d: unexpected data after the pipeline", line, col)
+	}
+
+	if err := pipeline.validate(); nil != err {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// quotedRe finds the JSON string (ex: a field name) in an error message
+var quotedRe = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// lineCol is the 1-based line and column of a byte offset
+func lineCol(b []byte, offset int64) (int, int) {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	before := b[:offset]
+	line := 1 + bytes.Count(before, []byte("\n"))
+	col := 1 + len(before) - (bytes.LastIndexByte(before, '\n') + 1)
+	return line, col
+}
+
+// validate checks everything that the JSON itself can't
+func (pipeline *Pipeline) validate() error {
+	if err := validateEnv("env", pipeline.Env); nil != err {
+		return err
+	}
+	if 0 == len(pipeline.Steps) {
+		return errors.New("steps: should have at least one step")
+	}
+
+	seen := map[string]bool{}
+	for i := range pipeline.Steps {
+		step := &pipeline.Steps[i]
+		where := fmt.Sprintf("steps[%d]", i)
+		if !stageNameRe.MatchString(step.Name) {
+			return fmt.Errorf("%s.name: %q should be letters, digits, dashes, and underscores", where, step.Name)
+		}
+		where = fmt.Sprintf("steps[%d] (%s)", i, step.Name)
+		if StageCheckout == step.Name {
+			return fmt.Errorf("%s.name: %q is done by gitdeploy itself", where, step.Name)
+		}
+		if seen[step.Name] {
+			return fmt.Errorf("%s.name: %q is used by an earlier step", where, step.Name)
+		}
+		seen[step.Name] = true
+
+		if "" == strings.TrimSpace(step.Run) {
+			return fmt.Errorf("%s.run: is required", where)
+		}
+		if err := validateEnv(where+".env", step.Env); nil != err {
+			return err
+		}
+		if step.Timeout < 0 {
+			return fmt.Errorf("%s.timeout: should not be negative", where)
+		}
+		for _, pattern := range append(append([]string{}, step.Branches...), step.Tags...) {
+			if _, err := path.Match(pattern, ""); nil != err {
+				return fmt.Errorf("%s: invalid ref pattern %q", where, pattern)
+			}
+		}
+		for _, pattern := range step.Artifacts {
+			if _, err := path.Match(pattern, ""); nil != err {
+				return fmt.Errorf("%s.artifacts: invalid pattern %q", where, pattern)
+			}
+			clean := path.Clean(pattern)
+			if "" == pattern || path.IsAbs(clean) || ".." == clean || strings.HasPrefix(clean, "../") {
+				return fmt.Errorf("%s.artifacts: %q should be a path in the repo", where, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func validateEnv(where string, env map[string]string) error {
+	for name := range env {
+		// the same rules as for input names
+		if !inputNameRe.MatchString(name) {
+			return fmt.Errorf("%s: %q should be letters, digits, and underscores", where, name)
+		}
+	}
+	return nil
+}
+
+// matches is true if the step should run for the ref
+func (step *PipelineStep) matches(hook *webhooks.Ref) bool {
+	if 0 == len(step.Branches) && 0 == len(step.Tags) {
+		return true
+	}
+	patterns := step.Branches
+	if "tag" == hook.RefType {
+		patterns = step.Tags
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, hook.RefName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// env is the step's ENVs (which include those of the whole pipeline)
+func (step *PipelineStep) env() []string {
+	envs := []string{}
+	for name, val := range step.Env {
+		envs = append(envs, name+"="+val)
+	}
+	return envs
+}
+
+// pipelineStages turns the pipeline's steps into stages, where the
+// steps that aren't for the ref are already skipped
+func pipelineStages(pipeline *Pipeline, hook *webhooks.Ref) []Stage {
+	stages := []Stage{}
+	for i := range pipeline.Steps {
+		step := pipeline.Steps[i]
+		env := map[string]string{}
+		for name, val := range pipeline.Env {
+			env[name] = val
+		}
+		for name, val := range step.Env {
+			env[name] = val
+		}
+		step.Env = env
+
+		status := StatusPending
+		if !step.matches(hook) {
+			status = StatusSkipped
+		}
+		stages = append(stages, Stage{
+			Name:   step.Name,
+			Always: step.Always,
+			Status: status,
+			step:   &step,
+		})
+	}
+	return stages
+}
+
+// readPipeline reads the checkout's pipeline file, if it has one
+func readPipeline(checkoutDir string) (*Pipeline, bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(checkoutDir, PipelineFile))
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, true, fmt.Errorf("%s: %v", PipelineFile, err)
+	}
+	pipeline, err := parsePipeline(b)
+	if nil != err {
+		return nil, true, fmt.Errorf("%s: %v", PipelineFile, err)
+	}
+	return pipeline, true, nil
+}
+
+// stepCmd runs the pipeline step with bash, in the checkout
+func stepCmd(step *PipelineStep, checkoutDir string) *exec.Cmd {
+	cmd := exec.Command("bash", "-o", "errexit", "-o", "nounset", "-c", step.Run)
+	cmd.Dir = checkoutDir
+	return cmd
+}
+
+// getCheckoutDir is where the checkout stage clones the repo
+func getCheckoutDir(workspace string, hook *webhooks.Ref) string {
+	return filepath.Join(workspace, hook.Repo)
+}
+
+// getArtifactsDir is where the job's artifacts are kept, next to its log
+func getArtifactsDir(logDir string, job *Job) string {
+	logDir, _ = filepath.Abs(logDir)
+	return filepath.Join(logDir, job.GitRef.RepoID, getJobLogName(job)+".artifacts")
+}
+
+// saveArtifacts copies the step's artifacts from the checkout to dir,
+// keeping their paths, and returns those paths
+func saveArtifacts(step *PipelineStep, checkoutDir, dir string) ([]string, error) {
+	saved := []string{}
+	for _, pattern := range step.Artifacts {
+		matches, _ := filepath.Glob(filepath.Join(checkoutDir, filepath.FromSlash(pattern)))
+		if 0 == len(matches) {
+			return saved, fmt.Errorf("artifact %q was not found", pattern)
+		}
+		for _, match := range matches {
+			err := filepath.WalkDir(match, func(src string, d fs.DirEntry, err error) error {
+				if nil != err {
+					return err
+				}
+				// symlinks are skipped, as they could point out of the checkout
+				if !d.Type().IsRegular() {
+					return nil
+				}
+				rel, _ := filepath.Rel(checkoutDir, src)
+				if err := copyFile(src, filepath.Join(dir, rel)); nil != err {
+					return err
+				}
+				saved = append(saved, filepath.ToSlash(rel))
+				return nil
+			})
+			if nil != err {
+				return saved, fmt.Errorf("could not save artifact %q: %v", pattern, err)
+			}
+		}
+	}
+	return saved, nil
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); nil != err {
+		return err
+	}
+	r, err := os.Open(src)
+	if nil != err {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if nil != err {
+		return err
+	}
+	if _, err := io.Copy(w, r); nil != err {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// ArtifactPath is the file of one of a job's artifacts,
+// by the job's ID and the artifact's path in the repo
+func ArtifactPath(runOpts *options.ServerConfig, id, name string) (string, error) {
+	job, ok := findActive(id)
+	if !ok {
+		value, ok := RecentRuns.Load(id)
+		if !ok {
+			return "", ErrUnknownArtifact
+		}
+		job = value.(*Job)
+	}
+
+	// can't escape the job's artifacts
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if "" == rel {
+		return "", ErrUnknownArtifact
+	}
+	artifactPath := filepath.Join(getArtifactsDir(runOpts.LogDir, job), filepath.FromSlash(rel))
+	if info, err := os.Stat(artifactPath); nil != err || !info.Mode().IsRegular() {
+		return "", ErrUnknownArtifact
+	}
+	return artifactPath, nil
+}
@@ -0,0 +1,216 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// PrioritiesFile holds the priority rules for every repo, ex: scripts/priorities.json
+const PrioritiesFile = "priorities.json"
+
+// Priority classes, in the order that queued jobs start
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var priorityRanks = map[string]int{
+	PriorityHigh:   0,
+	PriorityNormal: 1,
+	PriorityLow:    2,
+}
+
+// PriorityRule puts the jobs that match it in a priority class
+// (the first rule that matches wins, and the rest are normal)
+type PriorityRule struct {
+	// Class is high, normal, or low
+	Class string `json:"class"`
+	// Repos limits the rule to these repos, ex: github.com/org/* (only in PrioritiesFile)
+	Repos []string `json:"repos,omitempty"`
+	// Refs limits the rule to these branches or tags, ex: main or preview-*
+	Refs []string `json:"refs,omitempty"`
+	// Triggers limits the rule to these triggers, ex: manual or rollback
+	Triggers []string `json:"triggers,omitempty"`
+}
+
+// validatePriorities checks each rule's class and patterns
+func validatePriorities(rules []PriorityRule) error {
+	for _, rule := range rules {
+		if _, ok := priorityRanks[rule.Class]; !ok {
+			return fmt.Errorf("priority class %q should be %s, %s, or %s", rule.Class, PriorityHigh, PriorityNormal, PriorityLow)
+		}
+		for _, pattern := range rule.Refs {
+			if _, err := path.Match(pattern, ""); nil != err {
+				return fmt.Errorf("priority %q has an invalid ref pattern %q", rule.Class, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matches is true when the job is one of the rule's repos, refs, and triggers
+func (rule *PriorityRule) matches(job *Job) bool {
+	hook := job.GitRef
+	if len(rule.Repos) > 0 && !isTrusted(strings.Join(rule.Repos, " "), hook.RepoID) {
+		return false
+	}
+	if len(rule.Refs) > 0 {
+		var found bool
+		for _, pattern := range rule.Refs {
+			if ok, _ := path.Match(pattern, hook.RefName); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Triggers) > 0 {
+		trigger := job.Trigger
+		if "" == trigger {
+			trigger = TriggerWebhook
+		}
+		var found bool
+		for _, t := range rule.Triggers {
+			if t == trigger {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// the priority rules of every repo (guarded by repoConfigsMux)
+var priorities []PriorityRule
+
+// LoadPriorities reads the priority rules that apply to every repo
+func LoadPriorities(runOpts *options.ServerConfig) ([]PriorityRule, error) {
+	if 0 == len(runOpts.ScriptsPath) {
+		return nil, nil
+	}
+
+	prioritiesPath := filepath.Join(runOpts.ScriptsPath, PrioritiesFile)
+	b, err := ioutil.ReadFile(prioritiesPath)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	conf := struct {
+		Priorities []PriorityRule `json:"priorities"`
+	}{}
+	if err := json.Unmarshal(b, &conf); nil != err {
+		return nil, fmt.Errorf("could not parse %s: %v", prioritiesPath, err)
+	}
+	if err := validatePriorities(conf.Priorities); nil != err {
+		return nil, fmt.Errorf("invalid %s: %v", prioritiesPath, err)
+	}
+	return conf.Priorities, nil
+}
+
+// priorityClass is the class of the first rule that matches the job,
+// the repo's own rules before those for every repo
+func priorityClass(job *Job) string {
+	// copied, so as not to append to the repo config's own slice
+	rules := append([]PriorityRule{}, getRepoConfig(job.GitRef.RepoID).Priorities...)
+	repoConfigsMux.RLock()
+	rules = append(rules, priorities...)
+	repoConfigsMux.RUnlock()
+
+	for i := range rules {
+		if rules[i].matches(job) {
+			return rules[i].Class
+		}
+	}
+	return PriorityNormal
+}
+
+// sortQueue puts bumped refs first, and then orders the rest by priority class.
+// So that one busy repo can't hold up the others, refs of the same class are
+// ordered by how many jobs their repo already has running or ahead of them in line,
+// and then by when they were queued (jobsTimersMux must be held).
+func sortQueue() {
+	running := map[string]int{}
+	// a promotion is stored under several IDs, but is only one process
+	seen := map[*exec.Cmd]bool{}
+	Actives.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		job.mux.Lock()
+		cmd := job.cmd
+		job.mux.Unlock()
+		if !seen[cmd] {
+			seen[cmd] = true
+			running[strings.ToLower(job.GitRef.RepoID)]++
+		}
+		return true
+	})
+
+	type entry struct {
+		refID webhooks.RefID
+		rank  int
+		share int
+		seq   int
+	}
+	byArrival := make([]entry, 0, len(queue))
+	for _, refID := range queue {
+		q := entry{refID: refID, rank: priorityRanks[PriorityNormal], seq: arrivals[refID]}
+		if value, ok := Pending.Load(refID); ok {
+			q.rank = priorityRanks[priorityClass(value.(*Job))]
+		}
+		if seq, ok := bumped[refID]; ok {
+			// the last one bumped is first
+			q.rank = -1
+			q.seq = -seq
+		}
+		byArrival = append(byArrival, q)
+	}
+	sort.Slice(byArrival, func(i, j int) bool {
+		return byArrival[i].seq < byArrival[j].seq
+	})
+
+	// map[lowercase RepoID]map[rank]count
+	ahead := map[string]map[int]int{}
+	for i := range byArrival {
+		q := &byArrival[i]
+		if q.rank < 0 {
+			continue
+		}
+		var repoID string
+		if value, ok := Pending.Load(q.refID); ok {
+			repoID = strings.ToLower(value.(*Job).GitRef.RepoID)
+		}
+		if nil == ahead[repoID] {
+			ahead[repoID] = map[int]int{}
+		}
+		q.share = running[repoID] + ahead[repoID][q.rank]
+		ahead[repoID][q.rank]++
+	}
+
+	sort.SliceStable(byArrival, func(i, j int) bool {
+		a, b := byArrival[i], byArrival[j]
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		return a.share < b.share
+	})
+	for i := range byArrival {
+		queue[i] = byArrival[i].refID
+	}
+}
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package jobs
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op, as Windows has no process groups to signal
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup can only kill the job's own process on Windows
+func signalGroup(cmd *exec.Cmd, force bool) error {
+	return cmd.Process.Kill()
+}
+
+// exitSignal is always empty, as Windows has no signals
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// maxRSS is always 0, as Windows doesn't say
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"time"
@@ -27,6 +28,52 @@ func Promote(msg webhooks.Ref, promoteTo string) {
 	}
 }
 
+// promotions that are waiting on a free worker or lock, or for either ref's
+// job to finish, in the order they came (guarded by jobsTimersMux)
+var waitingPromotions = []Promotion{}
+
+// queuePromotion starts the promotion as soon as the same limits
+// and locks as any other job allow
+func queuePromotion(promotion Promotion, runOpts *options.ServerConfig) {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	waitingPromotions = append(waitingPromotions, promotion)
+	runPromotions(runOpts)
+	for _, waiting := range waitingPromotions {
+		if waiting == promotion {
+			log.Printf("[%s] promotion to %s queued (%s)",
+				promotion.GitRef.GetRefID(), promotion.PromoteTo, promoteWaitReason(promotion, runOpts))
+		}
+	}
+}
+
+// runPromotions starts as many of the waiting promotions as it can, in order
+// (jobsTimersMux must be held)
+func runPromotions(runOpts *options.ServerConfig) {
+	waiting := []Promotion{}
+	for _, promotion := range waitingPromotions {
+		if "" != promoteWaitReason(promotion, runOpts) {
+			waiting = append(waiting, promotion)
+			continue
+		}
+		promote(promotion.GitRef, promotion.PromoteTo, runOpts)
+	}
+	waitingPromotions = waiting
+}
+
+// promoteWaitReason explains why a promotion can't start yet, or is empty if it can
+func promoteWaitReason(promotion Promotion, runOpts *options.ServerConfig) string {
+	for _, refName := range []string{promotion.GitRef.RefName, promotion.PromoteTo} {
+		hook := *promotion.GitRef
+		hook.RefName = refName
+		if _, ok := Actives.Load(hook.GetRefID()); ok {
+			return fmt.Sprintf("waiting for the job of %s to finish", hook.GetRefID())
+		}
+	}
+	return waitReason(promotion.GitRef, runOpts)
+}
+
 // promote will run the promote script
 func promote(hook *webhooks.Ref, promoteTo string, runOpts *options.ServerConfig) {
 	// TODO create an origin-branch tag with a timestamp?
@@ -34,10 +81,12 @@ func promote(hook *webhooks.Ref, promoteTo string, runOpts *options.ServerConfig
 	hookTo := *hook
 	hookTo.RefName = promoteTo
 	jobID2 := hookTo.GetRefID()
+	// unique to each run, as with a deploy
+	promoteID := NewJobID()
 
 	args := []string{
 		runOpts.ScriptsPath + "/promote.sh",
-		string(jobID1),
+		promoteID,
 		promoteTo,
 		hook.RefName,
 		hook.RefType,
@@ -48,22 +97,12 @@ func promote(hook *webhooks.Ref, promoteTo string, runOpts *options.ServerConfig
 	cmd := exec.Command("bash", args...)
 
 	env := os.Environ()
-	envs := getEnvs(runOpts.Addr, string(jobID1), runOpts.RepoList, hook)
+	envs := getEnvs(runOpts.Addr, promoteID, promoteID, runOpts.RepoList, hook)
 	envs = append(envs, "GIT_DEPLOY_PROMOTE_TO="+promoteTo)
 	cmd.Env = append(env, envs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-
-	if _, ok := Actives.Load(jobID1); ok {
-		// TODO put promote in backlog
-		log.Printf("[promote] gitdeploy job already started for %s#%s\n", hook.HTTPSURL, hook.RefName)
-		return
-	}
-	if _, ok := Actives.Load(jobID2); ok {
-		// TODO put promote in backlog
-		log.Printf("[promote] gitdeploy job already started for %s#%s\n", hook.HTTPSURL, promoteTo)
-		return
-	}
+	setProcessGroup(cmd)
 
 	if err := cmd.Start(); nil != err {
 		log.Printf("gitdeploy exec error: %s\n", err)
@@ -71,39 +110,31 @@ func promote(hook *webhooks.Ref, promoteTo string, runOpts *options.ServerConfig
 	}
 
 	t := time.Now()
-	now := &t
-	promoteID := hook.RepoID + "#" + hook.RefName + ".." + promoteTo
-	Actives.Store(jobID1, &Job{
-		StartedAt: now,
-		ID:        promoteID,
-		GitRef:    hook,
-		PromoteTo: promoteTo,
-		Promote:   true, // deprecated
-		cmd:       cmd,
-	})
-	Actives.Store(jobID2, &Job{
-		StartedAt: now,
+	job := &Job{
+		StartedAt: &t,
 		ID:        promoteID,
 		GitRef:    hook,
 		PromoteTo: promoteTo,
 		Promote:   true, // deprecated
+		Locks:     getRepoConfig(hook.RepoID).Locks,
 		cmd:       cmd,
-	})
-	Actives.Store(promoteID, &Job{
-		StartedAt: now,
-		ID:        promoteID,
-		GitRef:    hook,
-		PromoteTo: promoteTo,
-		Promote:   true, // deprecated
-		cmd:       cmd,
-	})
+	}
+	// under both refs, so that neither is deployed while it runs
+	// (and each is removed by the same key through deathRow)
+	activeIDs := []webhooks.RefID{jobID1, jobID2}
+	for _, activeID := range activeIDs {
+		Actives.Store(activeID, job)
+	}
 
 	go func() {
 		log.Printf("gitdeploy promote for %s#%s started\n", hook.HTTPSURL, hook.RefName)
 		_ = cmd.Wait()
-		deathRow <- jobID1
-		deathRow <- jobID2
-		deathRow <- webhooks.RefID(promoteID)
+		job.mux.Lock()
+		job.finished = true
+		job.mux.Unlock()
+		for _, activeID := range activeIDs {
+			deathRow <- activeID
+		}
 		log.Printf("gitdeploy promote for %s#%s finished\n", hook.HTTPSURL, hook.RefName)
 		// TODO check for backlog
 	}()
@@ -0,0 +1,367 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// queue is the debounced refs that are waiting on a free worker or lock
+// (or on a pause or freeze to end), in order (see sortQueue).
+// Their refs stay in Pending (and the backlog) until they start.
+// (guarded by jobsTimersMux)
+var queue = []webhooks.RefID{}
+
+// map[webhooks.RefID]string (guarded by jobsTimersMux)
+var waitReasons = make(map[webhooks.RefID]string)
+
+// the order in which refs were queued, or bumped (guarded by jobsTimersMux)
+var queueSeq int
+
+// map[webhooks.RefID]int (guarded by jobsTimersMux)
+var arrivals = make(map[webhooks.RefID]int)
+
+// map[webhooks.RefID]int, the refs that were bumped to the front (guarded by jobsTimersMux)
+var bumped = make(map[webhooks.RefID]int)
+
+// checkQueue is sent when queued jobs may be able to start,
+// such as when a freeze ends or a job is bumped
+var checkQueue = make(chan struct{})
+
+func enqueue(refID webhooks.RefID, reason string) {
+	if _, ok := waitReasons[refID]; !ok {
+		queueSeq++
+		arrivals[refID] = queueSeq
+		queue = append(queue, refID)
+		sortQueue()
+		log.Printf("[%s] queued (%s)", refID, reason)
+	}
+	waitReasons[refID] = reason
+}
+
+func dequeue(refID webhooks.RefID) {
+	if _, ok := waitReasons[refID]; !ok {
+		return
+	}
+	delete(waitReasons, refID)
+	delete(arrivals, refID)
+	delete(bumped, refID)
+	for i := range queue {
+		if refID == queue[i] {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+}
+
+// queuePosition is 1-based, or 0 when the ref isn't waiting in line
+func queuePosition(refID webhooks.RefID) (int, string) {
+	for i := range queue {
+		if refID == queue[i] {
+			return i + 1, waitReasons[refID]
+		}
+	}
+	return 0, ""
+}
+
+// Queue lists the pending jobs: those waiting in line (in order), then
+// those still being debounced (soonest first), then the rest (oldest first)
+func Queue() []*Job {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	pendings := []*Job{}
+	Pending.Range(func(key, value interface{}) bool {
+		pendings = append(pendings, pendingCopy(value.(*Job)))
+		return true
+	})
+	for _, scheduled := range scheduledRetries {
+		pendings = append(pendings, retryCopy(scheduled))
+	}
+
+	sort.Slice(pendings, func(i, j int) bool {
+		a, b := pendings[i], pendings[j]
+		if (a.QueuePosition > 0) != (b.QueuePosition > 0) {
+			return a.QueuePosition > 0
+		}
+		if a.QueuePosition > 0 {
+			return a.QueuePosition < b.QueuePosition
+		}
+		if (nil != a.DebounceUntil) != (nil != b.DebounceUntil) {
+			return nil != a.DebounceUntil
+		}
+		if nil != a.DebounceUntil && !a.DebounceUntil.Equal(*b.DebounceUntil) {
+			return a.DebounceUntil.Before(*b.DebounceUntil)
+		}
+		return a.ID < b.ID
+	})
+	return pendings
+}
+
+// pendingCopy is what the API shows of a pending job (jobsTimersMux must be held)
+func pendingCopy(job *Job) *Job {
+	refID := job.GitRef.GetRefID()
+	jobCopy := &Job{
+		ID:          job.ID,
+		GitRef:      job.GitRef,
+		Status:      StatusPending,
+		Attempt:     job.Attempt,
+		RetryOf:     job.RetryOf,
+		Trigger:     job.Trigger,
+		TriggeredBy: job.TriggeredBy,
+		Inputs:      job.Inputs,
+		RollbackOf:  job.RollbackOf,
+		Upstream:    job.Upstream,
+		UpstreamID:  job.UpstreamID,
+		Priority:    priorityClass(job),
+		NextPush:    job.NextPush,
+	}
+	jobCopy.QueuePosition, jobCopy.WaitReason = queuePosition(refID)
+	if deadline, ok := debounceDeadlines[refID]; ok {
+		jobCopy.DebounceUntil = &deadline
+	}
+	return jobCopy
+}
+
+// retryCopy is what the API shows of a scheduled retry (jobsTimersMux must be held)
+func retryCopy(scheduled *scheduledRetry) *Job {
+	return &Job{
+		ID:          scheduled.job.ID,
+		GitRef:      scheduled.job.GitRef,
+		Status:      StatusPending,
+		Attempt:     scheduled.job.Attempt,
+		RetryOf:     scheduled.job.RetryOf,
+		Trigger:     scheduled.job.Trigger,
+		TriggeredBy: scheduled.job.TriggeredBy,
+		Inputs:      scheduled.job.Inputs,
+		RollbackOf:  scheduled.job.RollbackOf,
+		Upstream:    scheduled.job.Upstream,
+		UpstreamID:  scheduled.job.UpstreamID,
+		WaitReason:  "will retry at " + scheduled.at.UTC().Format(time.RFC3339),
+	}
+}
+
+// FindPending finds a pending job (or scheduled retry) by its ID, or by its
+// URL-safe RefID when nothing is running for that ref
+func FindPending(id string) (webhooks.RefID, bool) {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	var refID webhooks.RefID
+	Pending.Range(func(key, value interface{}) bool {
+		if id == value.(*Job).ID {
+			refID = key.(webhooks.RefID)
+			return false
+		}
+		return true
+	})
+	for key, scheduled := range scheduledRetries {
+		if id == scheduled.job.ID {
+			refID = key
+		}
+	}
+	if "" != refID {
+		return refID, true
+	}
+
+	if b, err := base64.RawURLEncoding.DecodeString(id); nil == err {
+		refID = webhooks.RefID(b)
+		if _, ok := Actives.Load(refID); ok {
+			return "", false
+		}
+		if _, ok := Pending.Load(refID); ok {
+			return refID, true
+		}
+		if _, ok := scheduledRetries[refID]; ok {
+			return refID, true
+		}
+	}
+	return "", false
+}
+
+// Cancel drops a pending (or debouncing) ref, or its scheduled retry,
+// along with its backlog file, so that it won't run
+func Cancel(runOpts *options.ServerConfig, refID webhooks.RefID) bool {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	return cancelPending(refID, runOpts)
+}
+
+// Flush cancels every pending ref and scheduled retry, and returns how many there were
+func Flush(runOpts *options.ServerConfig) int {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	refIDs := []webhooks.RefID{}
+	Pending.Range(func(key, value interface{}) bool {
+		refIDs = append(refIDs, key.(webhooks.RefID))
+		return true
+	})
+	for refID := range scheduledRetries {
+		if _, ok := Pending.Load(refID); !ok {
+			refIDs = append(refIDs, refID)
+		}
+	}
+
+	var n int
+	for _, refID := range refIDs {
+		if cancelPending(refID, runOpts) {
+			n++
+		}
+	}
+	return n
+}
+
+// cancelPending stops the ref's debounce timer, takes it out of the queue,
+// and removes its backlog file (jobsTimersMux must be held)
+func cancelPending(refID webhooks.RefID, runOpts *options.ServerConfig) bool {
+	value, pending := Pending.Load(refID)
+	_, retrying := scheduledRetries[refID]
+	if !pending && !retrying {
+		return false
+	}
+
+	cancelRetry(refID)
+	// if it already went off, there's no backlog left to run
+	stopDebounce(refID)
+	dequeue(refID)
+	if pending {
+		Pending.Delete(refID)
+		repoDir, repoFile, _ := getBacklogFilePath(runOpts.BacklogDir, value.(*Job).GitRef)
+		backlogFile := filepath.Join(repoDir, repoFile)
+		_ = os.Remove(backlogFile)
+		_ = os.Remove(backlogFile + ".cur")
+		log.Printf("[%s] canceled pending job %s", refID, value.(*Job).ID)
+		if next := value.(*Job).NextPush; nil != next {
+			log.Printf("[%s] canceled the push of %s along with it", refID, next)
+		}
+	}
+	return true
+}
+
+// Bump moves a pending ref to the front of the queue,
+// skipping whatever is left of its debounce
+func Bump(refID webhooks.RefID) bool {
+	jobsTimersMux.Lock()
+	if _, ok := Pending.Load(refID); !ok {
+		jobsTimersMux.Unlock()
+		return false
+	}
+	stopDebounce(refID)
+	queueSeq++
+	bumped[refID] = queueSeq
+	if _, ok := waitReasons[refID]; ok {
+		sortQueue()
+	} else {
+		enqueue(refID, "bumped to the front of the queue")
+	}
+	log.Printf("[%s] bumped to the front of the queue", refID)
+	jobsTimersMux.Unlock()
+
+	checkQueue <- struct{}{}
+	return true
+}
+
+// runQueued starts as many of the queued refs as the limits allow, in order
+func runQueued(runOpts *options.ServerConfig) {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	// the running jobs have changed since it was last sorted
+	sortQueue()
+	for _, refID := range append([]webhooks.RefID{}, queue...) {
+		value, ok := Pending.Load(refID)
+		if !ok {
+			dequeue(refID)
+			continue
+		}
+		if _, ok := Actives.Load(refID); ok {
+			// will be picked back up from the backlog when the active job ends
+			continue
+		}
+
+		pending := value.(*Job)
+		if reason := waitReason(pending.GitRef, runOpts); "" != reason {
+			waitReasons[refID] = reason
+			continue
+		}
+		start(pending, runOpts)
+	}
+	runPromotions(runOpts)
+}
+
+// waitReason explains why a job can't start yet, or is empty if it can
+func waitReason(hook *webhooks.Ref, runOpts *options.ServerConfig) string {
+	if reason, until := holdReason(hook, time.Now()); "" != reason {
+		if !until.IsZero() {
+			thawAt(until)
+		}
+		return reason
+	}
+
+	var total, repo, owner int
+	ownerID := getOwnerID(hook)
+	locks := getRepoConfig(hook.RepoID).Locks
+	lockHolders := map[string]*Job{}
+	// a promotion is stored under several IDs, but is only one process
+	seen := map[*exec.Cmd]bool{}
+	Actives.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		// a job with stages has a new cmd for each stage
+		job.mux.Lock()
+		cmd := job.cmd
+		job.mux.Unlock()
+		if seen[cmd] {
+			return true
+		}
+		seen[cmd] = true
+
+		for _, lock := range job.Locks {
+			lockHolders[lock] = job
+		}
+
+		total++
+		if strings.EqualFold(hook.RepoID, job.GitRef.RepoID) {
+			repo++
+		}
+		if ownerID == getOwnerID(job.GitRef) {
+			owner++
+		}
+		return true
+	})
+
+	for _, lock := range locks {
+		if holder, ok := lockHolders[lock]; ok {
+			return fmt.Sprintf(
+				"waiting for lock %q held by job %s (%s)",
+				lock, holder.ID, holder.GitRef.GetRefID(),
+			)
+		}
+	}
+	if runOpts.MaxJobs > 0 && total >= runOpts.MaxJobs {
+		return fmt.Sprintf("waiting on a free worker (%d of %d in use)", total, runOpts.MaxJobs)
+	}
+	if runOpts.MaxJobsPerRepo > 0 && repo >= runOpts.MaxJobsPerRepo {
+		return fmt.Sprintf("waiting on a free worker for %s (%d of %d in use)", hook.RepoID, repo, runOpts.MaxJobsPerRepo)
+	}
+	if runOpts.MaxJobsPerOwner > 0 && owner >= runOpts.MaxJobsPerOwner {
+		return fmt.Sprintf("waiting on a free worker for %s (%d of %d in use)", ownerID, owner, runOpts.MaxJobsPerOwner)
+	}
+	return ""
+}
+
+// getOwnerID returns the repo's owner including its host, ex: github.com/org
+func getOwnerID(hook *webhooks.Ref) string {
+	return strings.ToLower(path.Dir(hook.RepoID))
+}
@@ -0,0 +1,154 @@
+package jobs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// Policies for jobs that were interrupted by a server restart
+const (
+	// MarkInterrupted only records the interrupted job
+	MarkInterrupted = "mark"
+	// RequeueInterrupted records the interrupted job and runs it again
+	RequeueInterrupted = "requeue"
+)
+
+// saveJournal records that a job has started (and which stage it's on), so
+// that it can be recognized as interrupted if the server stops before it ends
+func saveJournal(job *Job, runOpts *options.ServerConfig) {
+	repoDir, repoFile, err := getJournalFilePath(runOpts.BacklogDir, job.GitRef)
+	if nil != err {
+		log.Printf("[warn] could not create journal dir %s:\n%v", repoDir, err)
+		return
+	}
+
+	b, _ := json.MarshalIndent(&Job{
+		StartedAt:   job.StartedAt,
+		ID:          job.ID,
+		GitRef:      job.GitRef,
+		Attempt:     job.Attempt,
+		RetryOf:     job.RetryOf,
+		Trigger:     job.Trigger,
+		TriggeredBy: job.TriggeredBy,
+		Inputs:      job.Inputs,
+		RollbackOf:  job.RollbackOf,
+		Upstream:    job.Upstream,
+		UpstreamID:  job.UpstreamID,
+		Priority:    job.Priority,
+		Stages:      job.Stages,
+	}, "", "  ")
+	journalPath := filepath.Join(repoDir, repoFile)
+	if err := ioutil.WriteFile(journalPath, b, 0644); nil != err {
+		log.Printf("[warn] could not write journal %s:\n%v", journalPath, err)
+	}
+}
+
+func removeJournal(job *Job, runOpts *options.ServerConfig) {
+	repoDir, repoFile, _ := getJournalFilePath(runOpts.BacklogDir, job.GitRef)
+	_ = os.Remove(filepath.Join(repoDir, repoFile))
+}
+
+func getJournalFilePath(baseDir string, hook *webhooks.Ref) (string, string, error) {
+	baseDir, _ = filepath.Abs(baseDir)
+	fileName := escapeRefName(hook.RefName) + ".running"
+	fileDir := filepath.Join(baseDir, hook.RepoID)
+
+	err := os.MkdirAll(fileDir, 0755)
+
+	return fileDir, fileName, err
+}
+
+// recoverJobs finds the jobs that were running when the server stopped,
+// marks them as interrupted, and keeps whatever they had logged
+func recoverJobs(runOpts *options.ServerConfig) []*Job {
+	interrupted := []*Job{}
+	if 0 == len(runOpts.BacklogDir) {
+		return interrupted
+	}
+
+	backlogDir, _ := filepath.Abs(runOpts.BacklogDir)
+	_ = filepath.WalkDir(backlogDir, func(journalPath string, d fs.DirEntry, err error) error {
+		if nil != err {
+			return nil
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(d.Name(), ".running") {
+			return nil
+		}
+
+		b, err := ioutil.ReadFile(journalPath)
+		if nil != err {
+			log.Printf("[warn] could not read journal %s:\n%v", journalPath, err)
+			return nil
+		}
+		job := &Job{}
+		if err := json.Unmarshal(b, job); nil != err || nil == job.GitRef {
+			log.Printf("[warn] could not parse journal %s:\n%v", journalPath, err)
+			_ = os.Remove(journalPath)
+			return nil
+		}
+		if !isJobID(job.ID) {
+			// started before jobs had IDs, and logged by the old name
+			job.logName = getJobLogName(&Job{GitRef: job.GitRef})
+			job.ID = legacyJobID(job.logName)
+		}
+
+		// the job ended, at the latest, when it last wrote to its log
+		endedAt := time.Now()
+		if info, err := d.Info(); nil == err {
+			endedAt = info.ModTime()
+		}
+		job.Logs = []Log{}
+		logdir, logname, _ := getJobFilePath(runOpts.LogDir, job, ".log")
+		if f, err := os.Open(filepath.Join(logdir, logname)); nil == err {
+			if info, err := f.Stat(); nil == err {
+				endedAt = info.ModTime()
+			}
+			job.Logs = readTextLog(f, endedAt)
+			_ = f.Close()
+		}
+		job.EndedAt = &endedAt
+		job.Status = StatusInterrupted
+		for i := range job.Stages {
+			switch job.Stages[i].Status {
+			case StatusRunning:
+				job.Stages[i].Status = StatusInterrupted
+				job.Stages[i].EndedAt = &endedAt
+			case StatusPending:
+				job.Stages[i].Status = StatusSkipped
+			}
+		}
+
+		log.Printf("[%s] was interrupted", job.GitRef.GetRefID())
+		writeJobLog(runOpts, job)
+		_ = os.Remove(journalPath)
+
+		interrupted = append(interrupted, job)
+		return nil
+	})
+
+	return interrupted
+}
+
+// readTextLog turns a partial text log into log messages.
+// The text log doesn't keep timing or stderr, so every line gets the same timestamp.
+func readTextLog(f *os.File, ts time.Time) []Log {
+	logs := []Log{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		logs = append(logs, Log{
+			Timestamp: ts.UTC(),
+			Text:      scanner.Text() + "\n",
+		})
+	}
+	return logs
+}
@@ -0,0 +1,152 @@
+package jobs
+
+import (
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// defaultRetryBackoff is used when a repo's retry config doesn't set a backoff
+const defaultRetryBackoff = 30 * time.Second
+
+var retries = make(chan *Job)
+
+type scheduledRetry struct {
+	job   *Job
+	at    time.Time
+	timer *time.Timer
+}
+
+// map[webhooks.RefID]*scheduledRetry (guarded by jobsTimersMux)
+var scheduledRetries = make(map[webhooks.RefID]*scheduledRetry)
+
+// scheduleRetry queues another attempt of a failed job, if its repo allows it
+// (jobsTimersMux must be held)
+func scheduleRetry(job *Job, runOpts *options.ServerConfig) {
+	conf := getRepoConfig(job.GitRef.RepoID).Retry
+	if nil == conf || !shouldRetry(job, conf) {
+		return
+	}
+
+	// each attempt gets its own timestamp, and so its own log
+	hook := *job.GitRef
+	hook.Timestamp = time.Now()
+	retryOf := job.RetryOf
+	if "" == retryOf {
+		retryOf = job.ID
+	}
+	retry := &Job{
+		ID:          NewJobID(),
+		GitRef:      &hook,
+		Attempt:     job.Attempt + 1,
+		RetryOf:     retryOf,
+		Trigger:     job.Trigger,
+		TriggeredBy: job.TriggeredBy,
+		Inputs:      job.Inputs,
+		RollbackOf:  job.RollbackOf,
+		Upstream:    job.Upstream,
+		UpstreamID:  job.UpstreamID,
+	}
+
+	refID := hook.GetRefID()
+	delay := retryBackoff(conf, job.Attempt)
+	log.Printf("[%s] will retry in %s (attempt %d of %d)", refID, delay, retry.Attempt, conf.MaxAttempts)
+	cancelRetry(refID)
+	scheduledRetries[refID] = &scheduledRetry{
+		job: retry,
+		at:  hook.Timestamp.Add(delay),
+		timer: time.AfterFunc(delay, func() {
+			retries <- retry
+		}),
+	}
+}
+
+// shouldRetry is true for a failed attempt (that wasn't killed on purpose)
+// which has attempts left and, if limited, one of the retryable exit codes
+func shouldRetry(job *Job, conf *RetryConfig) bool {
+	if job.Promote || StatusFailed != job.Status || EndKilled == job.EndReason {
+		return false
+	}
+	if job.Attempt >= conf.MaxAttempts {
+		return false
+	}
+	if 0 == len(conf.ExitCodes) {
+		return true
+	}
+	if nil == job.ExitCode {
+		return false
+	}
+	for _, code := range conf.ExitCodes {
+		if code == *job.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryBackoff doubles for each attempt, up to the max backoff
+func retryBackoff(conf *RetryConfig, attempt int) time.Duration {
+	backoff := time.Duration(conf.Backoff)
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := time.Duration(conf.MaxBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if maxBackoff > 0 && backoff >= maxBackoff {
+			break
+		}
+	}
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// cancelRetry drops a scheduled retry, such as when a newer push arrives
+// (jobsTimersMux must be held)
+func cancelRetry(refID webhooks.RefID) {
+	scheduled, ok := scheduledRetries[refID]
+	if !ok {
+		return
+	}
+	scheduled.timer.Stop()
+	delete(scheduledRetries, refID)
+	log.Printf("[%s] canceled retry (attempt %d)", refID, scheduled.job.Attempt)
+}
+
+// takeRetry claims a retry whose backoff has passed, unless it was canceled meanwhile
+func takeRetry(retry *Job) bool {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	refID := retry.GitRef.GetRefID()
+	scheduled, ok := scheduledRetries[refID]
+	if !ok || retry != scheduled.job {
+		return false
+	}
+	delete(scheduledRetries, refID)
+
+	if _, ok := Pending.Load(refID); ok {
+		log.Printf("[%s] not retrying: a newer push is pending", refID)
+		return false
+	}
+	return true
+}
+
+// saveRetries moves the scheduled retries into the backlog, for the next start
+func saveRetries(runOpts *options.ServerConfig) {
+	jobsTimersMux.Lock()
+	defer jobsTimersMux.Unlock()
+
+	for refID, scheduled := range scheduledRetries {
+		scheduled.timer.Stop()
+		delete(scheduledRetries, refID)
+		if _, ok := Pending.Load(refID); ok {
+			continue
+		}
+		saveBacklog(scheduled.job, runOpts)
+	}
+}
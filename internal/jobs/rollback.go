@@ -0,0 +1,162 @@
+package jobs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// ErrUnknownJob means that no deploy of the rev could be found,
+// neither in the recent jobs nor in the logs
+var ErrUnknownJob = errors.New("no deploy found for that rev")
+
+// ErrRevFailed means that the rev never deployed successfully
+// (and so a rollback to it must be forced)
+var ErrRevFailed = errors.New("the rev never deployed successfully")
+
+// FindDeployed returns the job that a rollback to the rev would replay:
+// its newest successful deploy or, when force is true and there is none,
+// its newest deploy of any status. Older jobs are read from the logs.
+func FindDeployed(runOpts *options.ServerConfig, revID webhooks.RevID, force bool) (*Job, error) {
+	deployed := []*Job{}
+	RecentRuns.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		if hasRevID(job.GitRef, revID) {
+			deployed = append(deployed, job)
+		}
+		return true
+	})
+	deployed = append(deployed, readDeployed(runOpts.LogDir, revID)...)
+	if 0 == len(deployed) {
+		return nil, ErrUnknownJob
+	}
+
+	var newest *Job
+	for _, job := range deployed {
+		if job.Promote || StatusSucceeded != job.Status {
+			continue
+		}
+		if nil == newest || job.GitRef.Timestamp.After(newest.GitRef.Timestamp) {
+			newest = job
+		}
+	}
+	if nil != newest {
+		return newest, nil
+	}
+	if !force {
+		return nil, ErrRevFailed
+	}
+	for _, job := range deployed {
+		if nil == newest || job.GitRef.Timestamp.After(newest.GitRef.Timestamp) {
+			newest = job
+		}
+	}
+	return newest, nil
+}
+
+// readDeployed reads the json logs of the rev's jobs (newest first),
+// which are kept until ExpiredLogAge
+func readDeployed(logDir string, revID webhooks.RevID) []*Job {
+	deployed := []*Job{}
+	if "" == logDir {
+		return deployed
+	}
+
+	// ex: github.com/org/project#abc1234
+	i := strings.LastIndex(string(revID), "#")
+	if i < 0 {
+		return deployed
+	}
+	repoID := string(revID)[:i]
+	rev := strings.ToLower(string(revID)[i+1:])
+
+	baseDir, _ := filepath.Abs(logDir)
+	repoDir := filepath.Join(baseDir, filepath.FromSlash(repoID))
+	infos, err := ioutil.ReadDir(repoDir)
+	if nil != err {
+		return deployed
+	}
+	logNames := []string{}
+	for _, info := range infos {
+		// older logs only have the first few characters of the rev
+		name, ok := parseJobLogName(info.Name())
+		if !ok || "json" != name.Ext {
+			continue
+		}
+		if !strings.HasPrefix(name.Rev, rev) && !strings.HasPrefix(rev, name.Rev) {
+			continue
+		}
+		logNames = append(logNames, info.Name())
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(logNames)))
+
+	for _, logname := range logNames {
+		b, err := ioutil.ReadFile(filepath.Join(repoDir, logname))
+		if nil != err {
+			continue
+		}
+		job := &Job{}
+		if err := json.Unmarshal(b, job); nil != err || nil == job.GitRef || !hasRevID(job.GitRef, revID) {
+			continue
+		}
+		job.Logs = []Log{}
+		name, _ := parseJobLogName(logname)
+		setLoggedID(job, name, logname)
+		deployed = append(deployed, job)
+	}
+	return deployed
+}
+
+// Rollback puts a job in the queue that deploys the same rev of the same
+// ref (with the same inputs) as the job it replays. When now is true it
+// skips the debounce (but still waits its turn).
+// It returns the pending job, as it was queued.
+func Rollback(replay *Job, triggeredBy string, now bool) *Job {
+	hook := *replay.GitRef
+	hook.Timestamp = time.Now().UTC()
+	pending := &Job{
+		ID:          NewJobID(),
+		GitRef:      &hook,
+		Status:      StatusPending,
+		Trigger:     TriggerRollback,
+		TriggeredBy: triggeredBy,
+		Inputs:      replay.Inputs,
+		RollbackOf:  replay.ID,
+	}
+	deployments <- deployment{
+		job: &Job{
+			ID:          pending.ID,
+			GitRef:      pending.GitRef,
+			Trigger:     pending.Trigger,
+			TriggeredBy: pending.TriggeredBy,
+			Inputs:      pending.Inputs,
+			RollbackOf:  pending.RollbackOf,
+		},
+		now: now,
+	}
+	return pending
+}
+
+// ParseRevID accepts a RevID (ex: github.com/org/project#abc1234)
+// or its URL-safe form, as listed in the jobs' ids
+func ParseRevID(id string) (webhooks.RevID, error) {
+	if !strings.Contains(id, "#") {
+		b, err := base64.RawURLEncoding.DecodeString(id)
+		if nil != err {
+			return "", errors.New("rev id is neither a RevID nor its URL-safe base64")
+		}
+		id = string(b)
+	}
+	if !strings.Contains(id, "#") || strings.HasSuffix(id, "#") {
+		return "", errors.New("rev id should be in the form 'github.com/org/project#abc1234'")
+	}
+	return webhooks.RevID(id), nil
+}
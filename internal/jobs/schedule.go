@@ -0,0 +1,283 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+	"git.rootprojects.org/root/gitdeploy/internal/options"
+)
+
+// ScheduleConfig deploys one of the repo's refs at set times, even without a push
+type ScheduleConfig struct {
+	// Cron is when to deploy, in the server's time zone,
+	// ex: "0 3 * * *" (3am each day) or "@daily"
+	Cron string `json:"cron"`
+	// Ref is the branch or tag to deploy, ex: main
+	Ref string `json:"ref"`
+	// RefType is branch (default) or tag
+	RefType string `json:"ref_type,omitempty"`
+
+	spec *cronSpec
+}
+
+// validateSchedules parses each schedule's cron expression
+func validateSchedules(schedules []ScheduleConfig) error {
+	for i := range schedules {
+		sched := &schedules[i]
+		if "" == sched.Ref {
+			return fmt.Errorf("schedule %q should say which ref to deploy", sched.Cron)
+		}
+		if "" != sched.RefType && "branch" != sched.RefType && "tag" != sched.RefType {
+			return fmt.Errorf("schedule %q has unknown ref_type %q", sched.Cron, sched.RefType)
+		}
+		spec, err := parseCron(sched.Cron)
+		if nil != err {
+			return err
+		}
+		if spec.next(time.Now()).IsZero() {
+			return fmt.Errorf("schedule %q never comes", sched.Cron)
+		}
+		sched.spec = spec
+	}
+	return nil
+}
+
+type scheduledRef struct {
+	repoID string
+	sched  *ScheduleConfig
+}
+
+// schedule deploys each scheduled ref when its time comes, until stop is closed
+func schedule(runOpts *options.ServerConfig, stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		next, due := nextScheduled(now)
+		if 0 == len(due) {
+			return
+		}
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if time.Now().Before(next) {
+			// the clock was changed
+			continue
+		}
+		for _, s := range due {
+			go deploySchedule(runOpts, s.repoID, s.sched)
+		}
+	}
+}
+
+// nextScheduled returns the next time that a schedule comes,
+// and every schedule that comes at that time
+func nextScheduled(now time.Time) (time.Time, []scheduledRef) {
+	repoConfigsMux.RLock()
+	defer repoConfigsMux.RUnlock()
+
+	var next time.Time
+	var due []scheduledRef
+	for repoID, conf := range repoConfigs {
+		for i := range conf.Schedules {
+			sched := &conf.Schedules[i]
+			if nil == sched.spec {
+				continue
+			}
+			t := sched.spec.next(now)
+			switch {
+			case t.IsZero():
+				// never
+			case next.IsZero() || t.Before(next):
+				next = t
+				due = []scheduledRef{{repoID, sched}}
+			case t.Equal(next):
+				due = append(due, scheduledRef{repoID, sched})
+			}
+		}
+	}
+	return next, due
+}
+
+// deploySchedule queues the scheduled ref at whatever rev it's at now
+// (through the same debounce and backlog as a push)
+func deploySchedule(runOpts *options.ServerConfig, repoID string, sched *ScheduleConfig) {
+	hook, err := ResolveRef(runOpts, repoID, sched.Ref, sched.RefType, "")
+	if nil != err {
+		log.Printf("[%s#%s] could not deploy on schedule %q: %v", repoID, sched.Ref, sched.Cron, err)
+		return
+	}
+	deployments <- deployment{
+		job: &Job{
+			ID:          NewJobID(),
+			GitRef:      hook,
+			Trigger:     TriggerSchedule,
+			TriggeredBy: sched.Cron,
+		},
+	}
+}
+
+// cronSpec is a parsed cron expression, with a bit set for each field
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// when either day field is *, only the other one limits the day
+	// (otherwise a day matches either one, as with cron)
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// parseCron reads a standard 5-field cron expression
+// (minute hour day-of-month month day-of-week) or a macro such as @daily
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		fields = strings.Fields(macro)
+	}
+	if 5 != len(fields) {
+		return nil, fmt.Errorf("cron %q should have 5 fields: minute hour day month weekday", expr)
+	}
+
+	bits := make([]uint64, len(fields))
+	for i := range fields {
+		b, err := cronFields[i].parse(fields[i])
+		if nil != err {
+			return nil, fmt.Errorf("cron %q: %s: %v", expr, cronFields[i].name, err)
+		}
+		bits[i] = b
+	}
+	// 7 is Sunday too
+	if 0 != bits[4]&(1<<7) {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	return &cronSpec{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parse reads a list of values, ranges, and steps, ex: 1,15 or 9-17 or */10
+func (field cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if nil != err || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := field.min, field.max
+		if "*" != rng {
+			var err error
+			ends := strings.SplitN(rng, "-", 2)
+			if lo, err = field.value(ends[0]); nil != err {
+				return 0, err
+			}
+			hi = lo
+			if 2 == len(ends) {
+				if hi, err = field.value(ends[1]); nil != err {
+					return 0, err
+				}
+			} else if step > 1 {
+				// 5/15 is 5-59/15
+				hi = field.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value reads a number or a name, ex: 3 or mar
+func (field cronField) value(s string) (int, error) {
+	for i, name := range field.names {
+		if strings.EqualFold(s, name) {
+			return field.min + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if nil != err || n < field.min || n > field.max {
+		return 0, fmt.Errorf("%q should be %d-%d", s, field.min, field.max)
+	}
+	return n, nil
+}
+
+// next returns the first matching minute after t (in t's time zone),
+// or the zero time if there isn't one within a few years (ex: Feb 31)
+func (spec *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Feb 29 is the rarest day, at 8 years apart (across 2100)
+	end := t.AddDate(9, 0, 0)
+	for t.Before(end) {
+		if 0 == spec.month&(1<<uint(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !spec.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if 0 == spec.hour&(1<<uint(t.Hour())) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if 0 == spec.minute&(1<<uint(t.Minute())) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (spec *cronSpec) matchDay(t time.Time) bool {
+	dom := 0 != spec.dom&(1<<uint(t.Day()))
+	dow := 0 != spec.dow&(1<<uint(t.Weekday()))
+	if spec.domAny || spec.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,264 @@
+package jobs
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/log"
+)
+
+// StageConfig is one step of a repo's pipeline, ex: build, test, deploy, verify.
+// Each stage runs deploy.sh again, with GIT_DEPLOY_STAGE set to its name.
+type StageConfig struct {
+	Name string `json:"name"`
+	// Always runs the stage even after an earlier stage failed (ex: notify, clean up)
+	Always bool `json:"always,omitempty"`
+}
+
+// StatusSkipped is a stage that didn't run, because an earlier stage
+// failed or because its pipeline step isn't for the ref
+const StatusSkipped = "skipped"
+
+// Stage is the status and timing of one stage of a job
+type Stage struct {
+	Name      string     `json:"name"`
+	Always    bool       `json:"always,omitempty"`
+	Status    string     `json:"status"` // pending, running, succeeded, failed, skipped, interrupted
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Signal    string     `json:"signal,omitempty"`
+	EndReason string     `json:"end_reason,omitempty"` // empty unless the stage's own timeout killed it
+	Error     string     `json:"error,omitempty"`      // why the stage failed, if not by its exit code
+	Artifacts []string   `json:"artifacts,omitempty"`  // the files that the stage saved
+	// internal only
+	step *PipelineStep // empty unless the stage is a step of a pipeline file
+}
+
+var stageNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateStages checks that the stages have names that can be used as file names
+func validateStages(stages []StageConfig) error {
+	seen := map[string]bool{}
+	for _, stage := range stages {
+		if !stageNameRe.MatchString(stage.Name) {
+			return fmt.Errorf("stage name %q should be letters, digits, dashes, and underscores", stage.Name)
+		}
+		if seen[stage.Name] {
+			return fmt.Errorf("stage %q is declared twice", stage.Name)
+		}
+		seen[stage.Name] = true
+	}
+	return nil
+}
+
+// newStages gives a job its (pending) stages, or none if the repo doesn't have any
+func newStages(stages []StageConfig) []Stage {
+	if 0 == len(stages) {
+		return nil
+	}
+	jobStages := make([]Stage, len(stages))
+	for i, stage := range stages {
+		jobStages[i] = Stage{
+			Name:   stage.Name,
+			Always: stage.Always,
+			Status: StatusPending,
+		}
+	}
+	return jobStages
+}
+
+// copyStages copies the stages so that the API can show them (job.mux must be held)
+func copyStages(stages []Stage) []Stage {
+	if nil == stages {
+		return nil
+	}
+	return append([]Stage{}, stages...)
+}
+
+// stageEnv is the ENV that tells deploy.sh which stage to run, ex: GIT_DEPLOY_STAGE=build
+func stageEnv(name string) string {
+	return "GIT_DEPLOY_STAGE=" + name
+}
+
+// startStage runs the i-th stage as cmd, unless the job has already been killed
+// (job.mux must be held)
+func startStage(job *Job, i int, cmd *exec.Cmd) error {
+	stage := &job.Stages[i]
+	if "" != job.EndReason {
+		stage.Status = StatusSkipped
+		return fmt.Errorf("job was stopped (%s)", job.EndReason)
+	}
+
+	now := time.Now()
+	stage.StartedAt = &now
+	stage.Status = StatusRunning
+	job.cmd = cmd
+	job.stage = stage.Name
+	if err := cmd.Start(); nil != err {
+		stage.EndedAt = &now
+		stage.Status = StatusFailed
+		return err
+	}
+	return nil
+}
+
+// endStage records how the i-th stage exited, and whether it failed
+// (job.mux must be held)
+func endStage(job *Job, i int) bool {
+	stage := &job.Stages[i]
+	now := time.Now()
+	stage.EndedAt = &now
+	stage.Status = StatusFailed
+	if state := job.cmd.ProcessState; nil != state {
+		exitCode := state.ExitCode()
+		stage.ExitCode = &exitCode
+		stage.Signal = exitSignal(state)
+		addUsage(job, state)
+		if 0 == exitCode {
+			stage.Status = StatusSucceeded
+		}
+	}
+	return StatusSucceeded != stage.Status
+}
+
+// stageRunner runs a job's stages in order, once start has started the first
+// one. Once a stage has failed, only the stages marked always are run,
+// and once the job is killed, none of them are.
+type stageRunner struct {
+	job *Job
+	// newCmd is the command for the i-th stage (job.mux is held)
+	newCmd func(i int) *exec.Cmd
+	// succeeded is called once the i-th stage has exited successfully,
+	// and may add more stages (ex: after the checkout) or fail it
+	succeeded func(i int) error
+	// started is called once each stage after the first has started
+	started         func()
+	killGracePeriod time.Duration
+}
+
+func (r *stageRunner) run() {
+	job := r.job
+	var failed bool
+	for i := 0; ; i++ {
+		job.mux.Lock()
+		if i >= len(job.Stages) {
+			job.mux.Unlock()
+			break
+		}
+		if i > 0 {
+			if StatusSkipped == job.Stages[i].Status || (failed && !job.Stages[i].Always) {
+				job.Stages[i].Status = StatusSkipped
+				job.mux.Unlock()
+				continue
+			}
+			cmd := r.newCmd(i)
+			// the same log as the stages before it
+			cmd.Stdout = job.cmd.Stdout
+			cmd.Stderr = job.cmd.Stderr
+			if err := startStage(job, i, cmd); nil != err {
+				job.mux.Unlock()
+				log.Printf("[%s] stage %s did not start: %v", job.GitRef.GetRefID(), job.Stages[i].Name, err)
+				failed = true
+				continue
+			}
+		}
+		cmd := job.cmd
+		name := job.Stages[i].Name
+		var timeout time.Duration
+		if step := job.Stages[i].step; nil != step {
+			timeout = time.Duration(step.Timeout)
+		}
+		job.mux.Unlock()
+		if i > 0 && nil != r.started {
+			r.started()
+		}
+
+		log.Printf("[%s] stage %s started", job.GitRef.GetRefID(), name)
+		var timer *time.Timer
+		if timeout > 0 {
+			stage := i
+			timer = time.AfterFunc(timeout, func() {
+				r.timeout(stage, cmd, timeout)
+			})
+		}
+		_ = cmd.Wait()
+		if nil != timer {
+			_ = timer.Stop()
+		}
+
+		job.mux.Lock()
+		stageFailed := endStage(job, i)
+		job.mux.Unlock()
+		if !stageFailed && nil != r.succeeded {
+			if err := r.succeeded(i); nil != err {
+				r.fail(i, err)
+				stageFailed = true
+			}
+		}
+		if stageFailed {
+			failed = true
+		}
+
+		job.mux.Lock()
+		status := job.Stages[i].Status
+		job.mux.Unlock()
+		log.Printf("[%s] stage %s %s", job.GitRef.GetRefID(), name, status)
+	}
+}
+
+// fail marks the i-th stage as failed with the given error, and logs it
+func (r *stageRunner) fail(i int, err error) {
+	job := r.job
+	job.mux.Lock()
+	job.Stages[i].Status = StatusFailed
+	job.Stages[i].Error = err.Error()
+	stderr := job.cmd.Stderr
+	job.mux.Unlock()
+	if nil != stderr {
+		_, _ = fmt.Fprintf(stderr, "%v\n", err)
+	}
+}
+
+// timeout kills the i-th stage's process tree (but not the job)
+func (r *stageRunner) timeout(i int, cmd *exec.Cmd, timeout time.Duration) {
+	job := r.job
+	job.mux.Lock()
+	job.Stages[i].EndReason = EndTimeout
+	name := job.Stages[i].Name
+	job.mux.Unlock()
+
+	log.Printf("[%s] stage %s timed out after %s", job.GitRef.GetRefID(), name, timeout)
+	if err := signalGroup(cmd, false); nil != err {
+		log.Printf("[%s] failed to terminate stage %s: %v", job.GitRef.GetRefID(), name, err)
+	}
+	time.AfterFunc(r.killGracePeriod, func() {
+		_ = signalGroup(cmd, true)
+	})
+}
+
+// betweenStages is true for a job with stages when none of them is running
+// (job.mux must be held)
+func betweenStages(job *Job) bool {
+	if 0 == len(job.Stages) {
+		return false
+	}
+	for i := range job.Stages {
+		if StatusRunning == job.Stages[i].Status {
+			return false
+		}
+	}
+	return true
+}
+
+// failedStage is the first stage that failed, if any
+func failedStage(job *Job) *Stage {
+	for i := range job.Stages {
+		if StatusFailed == job.Stages[i].Status {
+			return &job.Stages[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package jobs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
+)
+
+// maxRevLinks is how many pushes of each ref are remembered
+// for telling whether a late delivery is older than another
+const maxRevLinks = 100
+
+// revLinks chains a ref's pushes together by their before and after revs
+type revLinks struct {
+	// map[after]before
+	befores map[string]string
+	// the afters, oldest first, so that the oldest can be forgotten
+	order []string
+}
+
+var revsMux sync.Mutex
+
+// map[webhooks.RefID]*revLinks (guarded by revsMux)
+var pushChains = make(map[webhooks.RefID]*revLinks)
+
+// map[webhooks.RefID]string, the rev of each ref's newest successful deploy
+// (guarded by revsMux)
+var deployedRevs = make(map[webhooks.RefID]string)
+
+// staleReason explains why a webhook delivery is older than the rev that's
+// already deployed, running, or queued for its ref (or is empty if it isn't).
+// Webhooks may be delivered out of order, so a push is stale if a newer push
+// (one that came after it, going by their before revs) has already arrived.
+func staleReason(hook *webhooks.Ref) string {
+	refID := hook.GetRefID()
+
+	revsMux.Lock()
+	defer revsMux.Unlock()
+
+	chain := pushChains[refID]
+	if nil == chain {
+		chain = &revLinks{befores: map[string]string{}}
+		pushChains[refID] = chain
+	}
+	chain.link(hook.Rev, hook.Before)
+
+	type known struct {
+		rev  string
+		what string
+	}
+	newer := []known{}
+	if value, ok := Pending.Load(refID); ok {
+		newer = append(newer, known{value.(*Job).GitRef.Rev, "queued"})
+	}
+	if value, ok := Actives.Load(refID); ok {
+		newer = append(newer, known{value.(*Job).GitRef.Rev, "running"})
+	}
+	if rev, ok := deployedRevs[refID]; ok {
+		newer = append(newer, known{rev, "deployed"})
+	}
+	// a push that replaced what's already there is newer, even if a force push
+	// went back to a rev that came before it
+	for _, k := range newer {
+		if hook.Before == k.rev {
+			return ""
+		}
+	}
+	for _, k := range newer {
+		if k.rev != hook.Rev && chain.isAncestor(hook.Rev, k.rev) {
+			return fmt.Sprintf("%s came before the %s rev %s", hook.Rev, k.what, k.rev)
+		}
+	}
+	return ""
+}
+
+// rememberDeployed keeps the rev of a ref that deployed successfully
+func rememberDeployed(hook *webhooks.Ref) {
+	revsMux.Lock()
+	deployedRevs[hook.GetRefID()] = hook.Rev
+	revsMux.Unlock()
+}
+
+// rememberDeployedJobs keeps the pushes of jobs from before a restart, as read
+// back from their logs, and the rev of each ref's newest successful deploy
+func rememberDeployedJobs(jobs []*Job) {
+	endedAts := map[webhooks.RefID]time.Time{}
+
+	revsMux.Lock()
+	defer revsMux.Unlock()
+
+	for _, job := range jobs {
+		if nil == job.GitRef {
+			continue
+		}
+		refID := job.GitRef.GetRefID()
+		chain := pushChains[refID]
+		if nil == chain {
+			chain = &revLinks{befores: map[string]string{}}
+			pushChains[refID] = chain
+		}
+		chain.link(job.GitRef.Rev, job.GitRef.Before)
+
+		if job.Promote || StatusSucceeded != job.Status || nil == job.EndedAt {
+			continue
+		}
+		if _, ok := deployedRevs[refID]; ok {
+			if last, seeded := endedAts[refID]; !seeded || !job.EndedAt.After(last) {
+				continue
+			}
+		}
+		endedAts[refID] = *job.EndedAt
+		deployedRevs[refID] = job.GitRef.Rev
+	}
+}
+
+// link remembers that the push of rev replaced before
+func (chain *revLinks) link(rev, before string) {
+	if "" == rev || "" == before || rev == before {
+		return
+	}
+	if _, ok := chain.befores[rev]; !ok {
+		chain.order = append(chain.order, rev)
+	}
+	chain.befores[rev] = before
+	if len(chain.order) > maxRevLinks {
+		delete(chain.befores, chain.order[0])
+		chain.order = chain.order[1:]
+	}
+}
+
+// isAncestor follows the pushes back from rev, to see whether old came before it
+func (chain *revLinks) isAncestor(old, rev string) bool {
+	// a force push may have gone back to an older rev, which would loop
+	for i := 0; i <= len(chain.order); i++ {
+		before, ok := chain.befores[rev]
+		if !ok {
+			return false
+		}
+		if old == before {
+			return true
+		}
+		rev = before
+	}
+	return false
+}
@@ -3,6 +3,18 @@ set -e
 set -u
 #set -x
 
-echo "[${GIT_REPO_ID:-}#${GIT_REF_NAME:-}] Started at ${GIT_DEPLOY_TIMESTAMP:-}"
+echo "[${GIT_REPO_ID:-}#${GIT_REF_NAME:-}] Started ${GIT_DEPLOY_STAGE:-} at ${GIT_DEPLOY_TIMESTAMP:-}"
+if [[ -n "${GIT_UPSTREAM_REPO_ID:-}" ]]; then
+    echo "after ${GIT_UPSTREAM_REPO_ID}#${GIT_UPSTREAM_REF_NAME}"
+fi
+if [[ -n "${GIT_DEPLOY_TEST_CHILD:-}" ]] && [[ "orphan" == "${GIT_REF_NAME:-}" ]]; then
+    # a child that holds on to stdout, as a hung build would
+    sleep 7 &
+    echo $! > "${GIT_DEPLOY_TEST_CHILD}/${GIT_REPO_NAME}.pid"
+    wait
+fi
 sleep ${GIT_DEPLOY_TEST_WAIT:-0.1}
+if [[ "fail" == "${GIT_DEPLOY_STAGE:-}" ]]; then
+    exit 3
+fi
 echo "[${GIT_REPO_ID:-}#${GIT_REF_NAME:-}] Finished"
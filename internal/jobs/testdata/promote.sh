@@ -0,0 +1,7 @@
+#!/bin/bash
+set -e
+set -u
+
+echo "[${GIT_REPO_ID:-}#${GIT_REF_NAME:-}] Promoting to ${GIT_DEPLOY_PROMOTE_TO:-}"
+sleep ${GIT_DEPLOY_TEST_WAIT:-0.1}
+echo "[${GIT_REPO_ID:-}#${GIT_REF_NAME:-}] Promoted"
@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Usage is what a job used, summed over its stages
+type Usage struct {
+	UserTime    int64 `json:"user_time_ms"`   // CPU time in user code
+	SystemTime  int64 `json:"system_time_ms"` // CPU time in the kernel, on its behalf
+	WallTime    int64 `json:"wall_time_ms"`   // from when it started until it ended
+	MaxRSS      int64 `json:"max_rss_bytes"`  // the most memory held at once by any one of its processes
+	OutputBytes int64 `json:"output_bytes"`   // written to stdout and stderr
+}
+
+// addUsage adds the CPU time and memory of a process that exited (job.mux must be held)
+func addUsage(job *Job, state *os.ProcessState) {
+	job.usage.UserTime += state.UserTime().Milliseconds()
+	job.usage.SystemTime += state.SystemTime().Milliseconds()
+	if rss := maxRSS(state); rss > job.usage.MaxRSS {
+		job.usage.MaxRSS = rss
+	}
+}
+
+// endUsage is the job's usage, once it has ended (job.mux must be held)
+func endUsage(job *Job, endedAt time.Time) *Usage {
+	usage := job.usage
+	if nil != job.StartedAt {
+		usage.WallTime = endedAt.Sub(*job.StartedAt).Milliseconds()
+	}
+	return &usage
+}
+
+// RepoUsage adds up the usage of a repo's recent jobs
+// (MaxRSS is the most of any one job)
+type RepoUsage struct {
+	RepoID string `json:"repo_id"`
+	Jobs   int    `json:"jobs"`
+	Usage
+	AvgWallTime int64 `json:"avg_wall_time_ms"`
+}
+
+// UsageByRepo adds up the usage of each repo's jobs that are still
+// in the history (see StaleJobAge), the most CPU time first
+func UsageByRepo() []*RepoUsage {
+	repos := map[string]*RepoUsage{}
+	RecentRuns.Range(func(key, value interface{}) bool {
+		job := value.(*Job)
+		if nil == job.Usage {
+			// from before usage was kept, or it never started
+			return true
+		}
+		repoID := strings.ToLower(job.GitRef.RepoID)
+		repo, ok := repos[repoID]
+		if !ok {
+			repo = &RepoUsage{RepoID: job.GitRef.RepoID}
+			repos[repoID] = repo
+		}
+		repo.Jobs++
+		repo.UserTime += job.Usage.UserTime
+		repo.SystemTime += job.Usage.SystemTime
+		repo.WallTime += job.Usage.WallTime
+		repo.OutputBytes += job.Usage.OutputBytes
+		if job.Usage.MaxRSS > repo.MaxRSS {
+			repo.MaxRSS = job.Usage.MaxRSS
+		}
+		return true
+	})
+
+	list := []*RepoUsage{}
+	for _, repo := range repos {
+		repo.AvgWallTime = repo.WallTime / int64(repo.Jobs)
+		list = append(list, repo)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.UserTime+a.SystemTime != b.UserTime+b.SystemTime {
+			return a.UserTime+a.SystemTime > b.UserTime+b.SystemTime
+		}
+		return a.RepoID < b.RepoID
+	})
+	return list
+}
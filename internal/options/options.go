@@ -13,18 +13,26 @@ type ServerConfig struct {
 	Addr              string
 	TrustProxy        bool
 	RepoList          string
+	Pipelines         bool // check out trusted repos without scripts of their own, and run their pipeline files
 	Compress          bool
 	ServePath         string
 	ScriptsPath       string
 	Promotions        []string
 	LogDir            string // where the job logs should go
-	TmpDir            string // where the backlog files go
+	BacklogDir        string // where the backlog files go
+	InterruptedJobs   string // what to do with jobs that were running when the server stopped
+	MaxJobs           int    // how many jobs may run at once (0 for no limit)
+	MaxJobsPerRepo    int
+	MaxJobsPerOwner   int
 	DebounceDelay     time.Duration
 	DefaultMaxJobTime time.Duration
+	IdleTimeout       time.Duration // how long a job may go without output (0 for no limit)
 	StaleJobAge       time.Duration // how old a dead job is before it's stale
+	ShutdownTimeout   time.Duration // how long to wait for active jobs when stopping
+	KillGracePeriod   time.Duration // how long between SIGTERM and SIGKILL
+	RevAbbrev         int           // how many characters of a rev to show
 	StaleLogAge       time.Duration
 	ExpiredLogAge     time.Duration
-	// TODO use BacklogDir instead?
 }
 
 // ServerFlags are the flags the web server can use
@@ -33,6 +41,9 @@ var ServerFlags *flag.FlagSet
 // InitFlags are the flags for the main binary itself
 var InitFlags *flag.FlagSet
 
+// DeployFlags are the flags for asking a running server for a deploy
+var DeployFlags *flag.FlagSet
+
 // DefaultMaxBodySize is for the web server input
 var DefaultMaxBodySize int64 = 1024 * 1024
 
@@ -43,4 +54,5 @@ func init() {
 	Server = &ServerConfig{}
 	ServerFlags = flag.NewFlagSet("run", flag.ExitOnError)
 	InitFlags = flag.NewFlagSet("init", flag.ExitOnError)
+	DeployFlags = flag.NewFlagSet("deploy", flag.ExitOnError)
 }
@@ -127,10 +127,10 @@ func InitWebhook(providername string, secretList *string, envname string) func()
 					//branch = refName
 				}
 
-				var rev string
+				// a tag that was pushed without new commits has only its target
+				rev := info.Push.Changes[0].New.Target.Hash
 				if len(info.Push.Changes[0].Commits) > 0 {
 					// TODO first or last?
-					// TODO shouldn't tags have a Commit as well?
 					rev = info.Push.Changes[0].Commits[0].Hash
 				}
 
@@ -138,6 +138,7 @@ func InitWebhook(providername string, secretList *string, envname string) func()
 					// appears to be missing timestamp
 					HTTPSURL: info.Repository.Links.HTML.Href,
 					Rev:      rev,
+					Before:   info.Push.Changes[0].Old.Target.Hash,
 					Ref:      ref,
 					RefType:  refType,
 					RefName:  refName,
@@ -95,6 +95,7 @@ func InitWebhook(providername string, secretList *string, envname string) func()
 					HTTPSURL: info.Repository.CloneURL,
 					SSHURL:   info.Repository.SSHURL,
 					Rev:      info.After,
+					Before:   info.Before,
 					Ref:      ref,
 					RefType:  refType,
 					RefName:  refName,
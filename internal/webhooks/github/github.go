@@ -91,6 +91,7 @@ func InitWebhook(providername string, secretList *string, envname string) func()
 						HTTPSURL:  e.GetRepo().GetCloneURL(),
 						SSHURL:    e.GetRepo().GetSSHURL(),
 						Rev:       e.GetAfter(), // *e.After
+						Before:    e.GetBefore(),
 						Ref:       ref,
 						RefType:   refType,
 						RefName:   refName,
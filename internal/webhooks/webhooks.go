@@ -14,6 +14,7 @@ import (
 //     HTTPSURL ex: https://git@git.example.com/example/example.git
 //     SSHURL   ex: ssh://git@git.example.com/example/example.git
 //     Rev      ex: 00000000
+//     Before   ex: 00000000 (the rev that the push replaced)
 //     Ref      ex: /refs/heads/master
 //     Branch   ex: master
 //     Repo     ex: example
@@ -24,6 +25,7 @@ type Ref struct {
 	HTTPSURL  string    `json:"https_url"`
 	SSHURL    string    `json:"ssh_url"`
 	Rev       string    `json:"rev"`
+	Before    string    `json:"before,omitempty"` // empty when the provider doesn't say
 	Ref       string    `json:"ref"`      // refs/tags/v0.0.1, refs/heads/master
 	RefType   string    `json:"ref_type"` // tag, branch
 	RefName   string    `json:"ref_name"`
@@ -48,6 +50,10 @@ type URLSafeRevID string
 // URLSafeGitID is a newtype string
 type URLSafeGitID string
 
+// RevAbbrev is how many characters of a rev to show, ex: abcdef7
+// (revs are only ever abbreviated for display)
+var RevAbbrev = 7
+
 // New returns a normalized Ref (Git reference)
 func New(r Ref) *Ref {
 	if len(r.HTTPSURL) > 0 {
@@ -62,11 +68,20 @@ func New(r Ref) *Ref {
 
 // String prints object as git.example.com#branch@rev
 func (h *Ref) String() string {
-	rev := h.Rev
-	if len(rev) > 7 {
-		rev = rev[:7]
+	return string(h.GetRefID()) + "@" + h.ShortRev()
+}
+
+// ShortRev returns the rev abbreviated to RevAbbrev characters, for display
+func (h *Ref) ShortRev() string {
+	return AbbrevRev(h.Rev)
+}
+
+// AbbrevRev abbreviates a rev to RevAbbrev characters, for display
+func AbbrevRev(rev string) string {
+	if RevAbbrev > 0 && len(rev) > RevAbbrev {
+		return rev[:RevAbbrev]
 	}
-	return string(h.GetRefID()) + "@" + rev
+	return rev
 }
 
 // GetRefID returns a unique reference like "github.com/org/project#branch"
@@ -83,13 +98,10 @@ func (h *Ref) GetURLSafeRefID() URLSafeRefID {
 	)
 }
 
-// GetRevID returns a unique reference like "github.com/org/project#abcd7890"
+// GetRevID returns a unique reference with the full rev, like
+// "github.com/org/project#abcdef1234567890abcdef1234567890abcdef12"
 func (h *Ref) GetRevID() RevID {
-	rev := h.Rev
-	if len(rev) > 7 {
-		rev = rev[:7]
-	}
-	return RevID(h.RepoID + "#" + rev)
+	return RevID(h.RepoID + "#" + h.Rev)
 }
 
 // GetURLSafeRevID returns the URL-safe Base64 encoding of the RevID
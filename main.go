@@ -1,20 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"compress/flate"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"git.rootprojects.org/root/gitdeploy/assets/examples"
 	"git.rootprojects.org/root/gitdeploy/assets/public"
 	"git.rootprojects.org/root/gitdeploy/internal/api"
+	"git.rootprojects.org/root/gitdeploy/internal/jobs"
 	"git.rootprojects.org/root/gitdeploy/internal/log"
 	"git.rootprojects.org/root/gitdeploy/internal/options"
 	"git.rootprojects.org/root/gitdeploy/internal/webhooks"
@@ -39,6 +45,7 @@ func usage() {
 	fmt.Printf("Use '%s help <command>'\n", name)
 	fmt.Println("  init")
 	fmt.Println("  run")
+	fmt.Println("  deploy")
 }
 
 func ver() string {
@@ -48,6 +55,9 @@ func ver() string {
 var runOpts *options.ServerConfig
 var runFlags *flag.FlagSet
 var initFlags *flag.FlagSet
+var deployFlags *flag.FlagSet
+var deployMsg api.DeployMsg
+var deployServer string
 var promotionList string
 var defaultPromotionList = "production,staging,master"
 var oldScripts string
@@ -58,11 +68,26 @@ func init() {
 	initFlags = options.InitFlags
 	_ = initFlags.Bool("TODO", false, "init will eventually copy default assets into a local directory")
 
+	deployFlags = options.DeployFlags
+	deployFlags.StringVar(&deployServer, "server", "",
+		"the url of the running gitdeploy server (same as GITDEPLOY_URL=, default http://localhost:4483)")
+	deployFlags.StringVar(&deployMsg.RepoID, "repo", "", "the repo to deploy (ex: 'github.com/org/repo')")
+	deployFlags.StringVar(&deployMsg.RefName, "ref", "", "the branch or tag to deploy (ex: 'main')")
+	deployFlags.StringVar(&deployMsg.RefType, "ref-type", "branch", "'branch' or 'tag'")
+	deployFlags.StringVar(&deployMsg.Rev, "rev", "", "the rev to deploy (default: the latest rev of the ref)")
+	deployFlags.BoolVar(&deployMsg.Now, "now", false, "skip the debounce")
+	deployFlags.StringVar(&deployMsg.TriggeredBy, "by", "", "who is asking for the deploy (default $USER)")
+	deployMsg.Inputs = map[string]interface{}{}
+	deployFlags.Var(inputsFlag(deployMsg.Inputs), "input",
+		"a value for one of the repo's inputs, ex: 'clear_cache=true' (may be repeated)")
+
 	runFlags = options.ServerFlags
 	runFlags.StringVar(&runOpts.Addr, "listen", "", "the address and port on which to listen (default :4483)")
 	runFlags.BoolVar(&runOpts.TrustProxy, "trust-proxy", false, "trust X-Forwarded-For header")
 	runFlags.StringVar(&runOpts.RepoList, "trust-repos", "",
 		"list of repos (ex: 'github.com/org/repo', or '*' for all) for which to run '.gitdeploy/deploy.sh'")
+	runFlags.BoolVar(&runOpts.Pipelines, "pipelines", false,
+		"check out trusted repos that have no scripts directory of their own, and run their '"+jobs.PipelineFile+"' (same as PIPELINES=true)")
 	runFlags.BoolVar(&runOpts.Compress, "compress", true, "enable compression for text,html,js,css,etc")
 	runFlags.StringVar(
 		&runOpts.ServePath, "serve-path", "",
@@ -74,6 +99,24 @@ func init() {
 		&runOpts.ScriptsPath, "scripts", "",
 		"path to ./scripts/{deploy.sh,promote.sh,etc}")
 	//"path to bash script to run with git info as arguments")
+	runFlags.StringVar(&runOpts.BacklogDir, "backlog-dir", "",
+		"where to keep pending jobs so that they survive a restart (same as BACKLOG_DIR=, default ./backlog)")
+	runFlags.StringVar(&runOpts.InterruptedJobs, "interrupted-jobs", "",
+		"'mark' or 'requeue' jobs that were running when the server stopped (same as INTERRUPTED_JOBS=, default mark)")
+	runFlags.IntVar(&runOpts.MaxJobs, "max-jobs", 0,
+		"how many jobs may run at once, in total (same as MAX_JOBS=, default 0 for no limit)")
+	runFlags.IntVar(&runOpts.MaxJobsPerRepo, "max-jobs-per-repo", 0,
+		"how many jobs may run at once for any one repo (same as MAX_JOBS_PER_REPO=)")
+	runFlags.IntVar(&runOpts.MaxJobsPerOwner, "max-jobs-per-owner", 0,
+		"how many jobs may run at once for any one org or user (same as MAX_JOBS_PER_OWNER=)")
+	runFlags.DurationVar(&runOpts.ShutdownTimeout, "shutdown-timeout", 0,
+		"how long to wait for running jobs to finish before killing them on shutdown (same as SHUTDOWN_TIMEOUT=, default 30s)")
+	runFlags.DurationVar(&runOpts.IdleTimeout, "idle-timeout", 0,
+		"kill jobs that write no output for this long (same as IDLE_TIMEOUT=, default 0 for no limit)")
+	runFlags.DurationVar(&runOpts.KillGracePeriod, "kill-grace-period", 0,
+		"how long a job has to exit after SIGTERM before it gets SIGKILL (same as KILL_GRACE_PERIOD=, default 10s)")
+	runFlags.IntVar(&runOpts.RevAbbrev, "rev-abbrev", 0,
+		"how many characters of a rev to show in logs and messages (same as REV_ABBREV=, default 7)")
 	runFlags.StringVar(&promotionList, "promotions", "",
 		"a list of promotable branches in descending order (default '"+defaultPromotionList+"')")
 }
@@ -117,6 +160,10 @@ func main() {
 		gdInit()
 		os.Exit(0)
 		return
+	case "deploy":
+		_ = deployFlags.Parse(args[2:])
+		gdDeploy()
+		return
 	case "run":
 		_ = runFlags.Parse(args[2:])
 		if "" == runOpts.ScriptsPath {
@@ -156,31 +203,81 @@ func main() {
 		if 0 == len(runOpts.RepoList) {
 			runOpts.RepoList = os.Getenv("TRUST_REPOS")
 		}
+		if !runOpts.Pipelines {
+			runOpts.Pipelines = ("TRUE" == strings.ToUpper(os.Getenv("PIPELINES")))
+		}
 		if !runOpts.TrustProxy {
 			runOpts.TrustProxy = ("TRUE" == strings.ToUpper(os.Getenv("TRUST_PROXY")))
 		}
 		if 0 == len(runOpts.LogDir) {
 			runOpts.LogDir = os.Getenv("LOG_DIR")
 		}
-		if 0 == len(runOpts.TmpDir) {
-			var err error
-			runOpts.TmpDir, err = ioutil.TempDir("", "gitdeploy-*")
-			if nil != err {
-				fmt.Fprintf(os.Stderr, "could not create temporary directory")
-				os.Exit(1)
-				return
-			}
-			log.Printf("TEMP_DIR=%s", runOpts.TmpDir)
+		if 0 == len(runOpts.BacklogDir) {
+			runOpts.BacklogDir = os.Getenv("BACKLOG_DIR")
+		}
+		if 0 == len(runOpts.BacklogDir) {
+			runOpts.BacklogDir = "./backlog"
+		}
+		if err := os.MkdirAll(runOpts.BacklogDir, 0755); nil != err {
+			fmt.Fprintf(os.Stderr, "could not create backlog directory %q: %v\n", runOpts.BacklogDir, err)
+			os.Exit(1)
+			return
+		}
+		log.Printf("BACKLOG_DIR=%s", runOpts.BacklogDir)
+		if 0 == len(runOpts.InterruptedJobs) {
+			runOpts.InterruptedJobs = os.Getenv("INTERRUPTED_JOBS")
+		}
+		if 0 == len(runOpts.InterruptedJobs) {
+			runOpts.InterruptedJobs = jobs.MarkInterrupted
+		}
+		switch runOpts.InterruptedJobs {
+		case jobs.MarkInterrupted, jobs.RequeueInterrupted:
+			// ok
+		default:
+			fmt.Fprintf(os.Stderr, "--interrupted-jobs must be %q or %q\n", jobs.MarkInterrupted, jobs.RequeueInterrupted)
+			os.Exit(1)
+			return
+		}
+		if 0 == runOpts.MaxJobs {
+			runOpts.MaxJobs, _ = strconv.Atoi(os.Getenv("MAX_JOBS"))
+		}
+		if 0 == runOpts.MaxJobsPerRepo {
+			runOpts.MaxJobsPerRepo, _ = strconv.Atoi(os.Getenv("MAX_JOBS_PER_REPO"))
+		}
+		if 0 == runOpts.MaxJobsPerOwner {
+			runOpts.MaxJobsPerOwner, _ = strconv.Atoi(os.Getenv("MAX_JOBS_PER_OWNER"))
 		}
 		if 0 == runOpts.DefaultMaxJobTime {
 			runOpts.DefaultMaxJobTime = 10 * time.Minute
 		}
+		if 0 == runOpts.IdleTimeout {
+			runOpts.IdleTimeout, _ = time.ParseDuration(os.Getenv("IDLE_TIMEOUT"))
+		}
 		if 0 == runOpts.DebounceDelay {
 			runOpts.DebounceDelay = 5 * time.Second
 		}
 		if 0 == runOpts.StaleJobAge {
 			runOpts.StaleJobAge = 3 * 24 * time.Hour
 		}
+		if 0 == runOpts.ShutdownTimeout {
+			runOpts.ShutdownTimeout, _ = time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+		}
+		if 0 == runOpts.ShutdownTimeout {
+			runOpts.ShutdownTimeout = 30 * time.Second
+		}
+		if 0 == runOpts.KillGracePeriod {
+			runOpts.KillGracePeriod, _ = time.ParseDuration(os.Getenv("KILL_GRACE_PERIOD"))
+		}
+		if 0 == runOpts.KillGracePeriod {
+			runOpts.KillGracePeriod = 10 * time.Second
+		}
+		if 0 == runOpts.RevAbbrev {
+			runOpts.RevAbbrev, _ = strconv.Atoi(os.Getenv("REV_ABBREV"))
+		}
+		if 0 == runOpts.RevAbbrev {
+			runOpts.RevAbbrev = 7
+		}
+		webhooks.RevAbbrev = runOpts.RevAbbrev
 		if 0 == runOpts.StaleLogAge {
 			runOpts.StaleLogAge = 15 * 24 * time.Hour
 		}
@@ -259,6 +356,62 @@ func gdInit() {
 	fmt.Println("Done.")
 }
 
+// inputsFlag collects repeated --input name=value flags
+type inputsFlag map[string]interface{}
+
+func (f inputsFlag) String() string {
+	pairs := []string{}
+	for name, val := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, val))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (f inputsFlag) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if 2 != len(parts) || "" == parts[0] {
+		return fmt.Errorf("%q should be in the form name=value", pair)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+func gdDeploy() {
+	if "" == deployServer {
+		deployServer = os.Getenv("GITDEPLOY_URL")
+	}
+	if "" == deployServer {
+		deployServer = "http://localhost:4483"
+	}
+	if "" == deployMsg.TriggeredBy {
+		deployMsg.TriggeredBy = os.Getenv("USER")
+	}
+	if "" == deployMsg.RepoID || "" == deployMsg.RefName {
+		fmt.Fprintf(os.Stderr, "--repo and --ref are required\n")
+		os.Exit(1)
+		return
+	}
+
+	b, _ := json.Marshal(&deployMsg)
+	reqURL := strings.TrimRight(deployServer, "/") + "/api/admin/deploy"
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(reqURL, "application/json", bytes.NewReader(b))
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "could not reach %s: %v\n", reqURL, err)
+		os.Exit(1)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if http.StatusOK != resp.StatusCode {
+		fmt.Fprintf(os.Stderr, "deploy failed (%d):\n%s\n", resp.StatusCode, string(body))
+		os.Exit(1)
+		return
+	}
+	fmt.Printf("%s\n", strings.TrimSpace(string(body)))
+}
+
 func serve() {
 	r := chi.NewRouter()
 
@@ -321,7 +474,31 @@ func serve() {
 		WriteTimeout:      20 * time.Second,
 		MaxHeaderBytes:    1024 * 1024, // 1MiB
 	}
-	if err := srv.ListenAndServe(); nil != err {
+	go func() {
+		if err := srv.ListenAndServe(); nil != err && http.ErrServerClosed != err {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+			return
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("[gitdeploy] received %s, shutting down", sig)
+	go func() {
+		// don't wait on the jobs
+		sig := <-sigs
+		log.Printf("[gitdeploy] received %s again, exiting now", sig)
+		os.Exit(1)
+	}()
+
+	// the http server keeps running so that jobs can still report back
+	jobs.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); nil != err {
 		fmt.Fprintf(os.Stderr, "%s", err)
 		os.Exit(1)
 		return